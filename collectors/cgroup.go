@@ -0,0 +1,378 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cgroupEnabled = kingpin.Flag("collector.cgroup", "Enable the cgroup v2 collector").Default("false").Envar("CGROUP_ENABLED").Bool()
+	cgroupPerUser = kingpin.Flag("collector.cgroup.per-user", "Collect cgroup metrics labeled by PUN user").Default("false").Envar("CGROUP_PER_USER").Bool()
+	cgroupFS      = "/sys/fs/cgroup"
+	cgroupTracker = newCgroupCounterTracker()
+)
+
+type CgroupCollector struct {
+	Cgroups           *prometheus.Desc
+	MemoryCurrent     *prometheus.Desc
+	MemoryMax         *prometheus.Desc
+	MemoryEvents      *prometheus.Desc
+	CPUSeconds        *prometheus.Desc
+	CPUThrottled      *prometheus.Desc
+	Pids              *prometheus.Desc
+	UserMemoryCurrent *prometheus.Desc
+	UserMemoryMax     *prometheus.Desc
+	UserMemoryEvents  *prometheus.Desc
+	UserCPUSeconds    *prometheus.Desc
+	UserCPUThrottled  *prometheus.Desc
+	UserPids          *prometheus.Desc
+	logger            *slog.Logger
+}
+
+// CgroupMetrics are the resources of one or more cgroups, MemoryMax only includes cgroups with a limit.
+type CgroupMetrics struct {
+	MemoryCurrent float64
+	MemoryMax     float64
+	OOM           float64
+	OOMKill       float64
+	CPUUser       float64
+	CPUSystem     float64
+	CPUThrottled  float64
+	Pids          float64
+}
+
+type CgroupsMetrics struct {
+	Cgroups float64
+	Total   CgroupMetrics
+	Users   map[string]CgroupMetrics
+	// Cgroup paths of the processes of each PUN UID
+	UIDCgroups map[string][]string
+	Paths      map[string]CgroupMetrics
+}
+
+func (m *CgroupMetrics) add(o CgroupMetrics) {
+	m.MemoryCurrent += o.MemoryCurrent
+	m.MemoryMax += o.MemoryMax
+	m.OOM += o.OOM
+	m.OOMKill += o.OOMKill
+	m.CPUUser += o.CPUUser
+	m.CPUSystem += o.CPUSystem
+	m.CPUThrottled += o.CPUThrottled
+	m.Pids += o.Pids
+}
+
+// getPunCgroups returns the cgroup v2 paths of the processes of each PUN UID.
+func getPunCgroups(snapshot *ProcessSnapshot, puns []string, logger *slog.Logger) map[string][]string {
+	cgroups := make(map[string][]string)
+	for _, proc := range snapshot.Procs {
+		if !slices.Contains(puns, proc.UID) {
+			continue
+		}
+		procCgroups, err := proc.Cgroups()
+		if err != nil {
+			logger.Debug("Unable to get process cgroup", "pid", proc.PID, "uid", proc.UID, "err", err)
+			continue
+		}
+		for _, cgroup := range procCgroups {
+			// cgroup v2 has a single hierarchy with ID 0 and no controllers
+			if cgroup.HierarchyID != 0 || len(cgroup.Controllers) != 0 {
+				continue
+			}
+			if !slices.Contains(cgroups[proc.UID], cgroup.Path) {
+				cgroups[proc.UID] = append(cgroups[proc.UID], cgroup.Path)
+			}
+		}
+	}
+	return cgroups
+}
+
+// readCgroupValue reads a file of a single value, "max" is returned as 0.
+func readCgroupValue(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "max" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// readCgroupKeyValues reads a flat keyed file such as memory.events or cpu.stat.
+func readCgroupKeyValues(path string) (map[string]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		values[fields[0]] = value
+	}
+	return values, scanner.Err()
+}
+
+// getCgroupMetrics reads a cgroup, files of controllers that are not enabled are skipped.
+func getCgroupMetrics(path string, logger *slog.Logger) (CgroupMetrics, error) {
+	var metrics CgroupMetrics
+	dir := filepath.Join(cgroupFS, path)
+	if _, err := os.Stat(dir); err != nil {
+		return metrics, err
+	}
+	if value, err := readCgroupValue(filepath.Join(dir, "memory.current")); err == nil {
+		metrics.MemoryCurrent = value
+	} else {
+		logger.Debug("Unable to read cgroup memory.current", "cgroup", path, "err", err)
+	}
+	if value, err := readCgroupValue(filepath.Join(dir, "memory.max")); err == nil {
+		metrics.MemoryMax = value
+	} else {
+		logger.Debug("Unable to read cgroup memory.max", "cgroup", path, "err", err)
+	}
+	if values, err := readCgroupKeyValues(filepath.Join(dir, "memory.events")); err == nil {
+		metrics.OOM = values["oom"]
+		metrics.OOMKill = values["oom_kill"]
+	} else {
+		logger.Debug("Unable to read cgroup memory.events", "cgroup", path, "err", err)
+	}
+	if values, err := readCgroupKeyValues(filepath.Join(dir, "cpu.stat")); err == nil {
+		metrics.CPUUser = values["user_usec"] / microsecondsPerSecond
+		metrics.CPUSystem = values["system_usec"] / microsecondsPerSecond
+		metrics.CPUThrottled = values["throttled_usec"] / microsecondsPerSecond
+	} else {
+		logger.Debug("Unable to read cgroup cpu.stat", "cgroup", path, "err", err)
+	}
+	if value, err := readCgroupValue(filepath.Join(dir, "pids.current")); err == nil {
+		metrics.Pids = value
+	} else {
+		logger.Debug("Unable to read cgroup pids.current", "cgroup", path, "err", err)
+	}
+	return metrics, nil
+}
+
+// getCgroupsMetrics reads the cgroups of PUN processes, counting each cgroup once in the totals.
+func getCgroupsMetrics(snapshot *ProcessSnapshot, puns []string, logger *slog.Logger) (CgroupsMetrics, error) {
+	metrics := CgroupsMetrics{
+		Users: make(map[string]CgroupMetrics),
+		Paths: make(map[string]CgroupMetrics),
+	}
+	if snapshot == nil {
+		return metrics, errors.New("no procfs snapshot")
+	}
+	if _, err := os.Stat(filepath.Join(cgroupFS, "cgroup.controllers")); err != nil {
+		return metrics, err
+	}
+	metrics.UIDCgroups = getPunCgroups(snapshot, puns, logger)
+	for uid, paths := range metrics.UIDCgroups {
+		var user CgroupMetrics
+		for _, path := range paths {
+			m, ok := metrics.Paths[path]
+			if !ok {
+				var err error
+				m, err = getCgroupMetrics(path, logger)
+				if err != nil {
+					logger.Debug("Unable to read cgroup", "cgroup", path, "uid", uid, "err", err)
+					continue
+				}
+				metrics.Paths[path] = m
+				metrics.Total.add(m)
+			}
+			user.add(m)
+		}
+		metrics.Users[uid] = user
+	}
+	metrics.Cgroups = float64(len(metrics.Paths))
+	return metrics, nil
+}
+
+// counters returns the metrics that are counters, which are kept when a cgroup is removed.
+func (m CgroupMetrics) counters() CgroupMetrics {
+	return CgroupMetrics{OOM: m.OOM, OOMKill: m.OOMKill, CPUUser: m.CPUUser, CPUSystem: m.CPUSystem, CPUThrottled: m.CPUThrottled}
+}
+
+// reset returns true if any counter of m is lower than in o.
+func (m CgroupMetrics) reset(o CgroupMetrics) bool {
+	return m.OOM < o.OOM || m.OOMKill < o.OOMKill || m.CPUUser < o.CPUUser || m.CPUSystem < o.CPUSystem || m.CPUThrottled < o.CPUThrottled
+}
+
+type removedCgroup struct {
+	counters CgroupMetrics
+	uids     []string
+}
+
+// cgroupCounterTracker keeps the counters of removed PUN cgroups so the totals remain monotonic.
+type cgroupCounterTracker struct {
+	sync.Mutex
+	cgroups map[string]removedCgroup
+	removed map[string]removedCgroup
+	// Counters of removed cgroups of UIDs that are no longer PUNs
+	gone CgroupMetrics
+}
+
+func newCgroupCounterTracker() *cgroupCounterTracker {
+	return &cgroupCounterTracker{
+		cgroups: make(map[string]removedCgroup),
+		removed: make(map[string]removedCgroup),
+	}
+}
+
+// update adds the counters of removed and recreated cgroups to the totals and users of metrics.
+func (t *cgroupCounterTracker) update(metrics *CgroupsMetrics, puns []string, partial bool) {
+	t.Lock()
+	defer t.Unlock()
+	cgroups := make(map[string]removedCgroup)
+	for uid, paths := range metrics.UIDCgroups {
+		for _, path := range paths {
+			m, ok := metrics.Paths[path]
+			if !ok {
+				continue
+			}
+			c := cgroups[path]
+			c.counters = m.counters()
+			c.uids = append(c.uids, uid)
+			cgroups[path] = c
+		}
+	}
+	for path, c := range cgroups {
+		if r, ok := t.removed[path]; ok && !c.counters.reset(r.counters) {
+			delete(t.removed, path)
+		}
+	}
+	for path, c := range t.cgroups {
+		if _, ok := cgroups[path]; ok {
+			continue
+		}
+		if partial {
+			cgroups[path] = c
+			metrics.Total.add(c.counters)
+			for _, uid := range c.uids {
+				u := metrics.Users[uid]
+				u.add(c.counters)
+				metrics.Users[uid] = u
+			}
+			continue
+		}
+		r := t.removed[path]
+		r.counters.add(c.counters)
+		r.uids = c.uids
+		t.removed[path] = r
+	}
+	t.cgroups = cgroups
+	for path, r := range t.removed {
+		var pun bool
+		for _, uid := range r.uids {
+			pun = pun || slices.Contains(puns, uid)
+		}
+		if !pun && !partial {
+			t.gone.add(r.counters)
+			delete(t.removed, path)
+			continue
+		}
+		metrics.Total.add(r.counters)
+		for _, uid := range r.uids {
+			if !slices.Contains(puns, uid) {
+				continue
+			}
+			u := metrics.Users[uid]
+			u.add(r.counters)
+			metrics.Users[uid] = u
+		}
+	}
+	metrics.Total.add(t.gone)
+}
+
+func NewCgroupCollector(logger *slog.Logger) *CgroupCollector {
+	return &CgroupCollector{
+		logger:            logger,
+		Cgroups:           prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "cgroups"), "Number of cgroups containing PUN processes", nil, nil),
+		MemoryCurrent:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_cgroup", "memory_current_bytes"), "Memory used by cgroups of PUNs", nil, nil),
+		MemoryMax:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_cgroup", "memory_max_bytes"), "Memory limit of cgroups of PUNs that have a limit", nil, nil),
+		MemoryEvents:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_cgroup", "memory_events_total"), "Memory events of cgroups of PUNs", []string{"type"}, nil),
+		CPUSeconds:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_cgroup", "cpu_seconds_total"), "CPU time of cgroups of PUNs", []string{"mode"}, nil),
+		CPUThrottled:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_cgroup", "cpu_throttled_seconds_total"), "CPU time cgroups of PUNs were throttled", nil, nil),
+		Pids:              prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_cgroup", "pids"), "Number of processes in cgroups of PUNs", nil, nil),
+		UserMemoryCurrent: prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user_cgroup", "memory_current_bytes"), "Memory used by the cgroups of a PUN", []string{"user"}, nil),
+		UserMemoryMax:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user_cgroup", "memory_max_bytes"), "Memory limit of the cgroups of a PUN, 0 if there is no limit", []string{"user"}, nil),
+		UserMemoryEvents:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user_cgroup", "memory_events_total"), "Memory events of the cgroups of a PUN", []string{"user", "type"}, nil),
+		UserCPUSeconds:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user_cgroup", "cpu_seconds_total"), "CPU time of the cgroups of a PUN", []string{"user", "mode"}, nil),
+		UserCPUThrottled:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user_cgroup", "cpu_throttled_seconds_total"), "CPU time the cgroups of a PUN were throttled", []string{"user"}, nil),
+		UserPids:          prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user_cgroup", "pids"), "Number of processes in the cgroups of a PUN", []string{"user"}, nil),
+	}
+}
+
+func (c *CgroupCollector) collect(snapshot *ProcessSnapshot, puns []string, ch chan<- prometheus.Metric) error {
+	c.logger.Debug("Collecting cgroup metrics")
+	collectTime := time.Now()
+	metrics, err := getCgroupsMetrics(snapshot, puns, c.logger)
+	if err != nil {
+		return err
+	}
+	cgroupTracker.update(&metrics, puns, snapshot.Partial)
+	ch <- prometheus.MustNewConstMetric(c.Cgroups, prometheus.GaugeValue, metrics.Cgroups)
+	ch <- prometheus.MustNewConstMetric(c.MemoryCurrent, prometheus.GaugeValue, metrics.Total.MemoryCurrent)
+	ch <- prometheus.MustNewConstMetric(c.MemoryMax, prometheus.GaugeValue, metrics.Total.MemoryMax)
+	ch <- prometheus.MustNewConstMetric(c.MemoryEvents, prometheus.CounterValue, metrics.Total.OOM, "oom")
+	ch <- prometheus.MustNewConstMetric(c.MemoryEvents, prometheus.CounterValue, metrics.Total.OOMKill, "oom_kill")
+	ch <- prometheus.MustNewConstMetric(c.CPUSeconds, prometheus.CounterValue, metrics.Total.CPUUser, "user")
+	ch <- prometheus.MustNewConstMetric(c.CPUSeconds, prometheus.CounterValue, metrics.Total.CPUSystem, "system")
+	ch <- prometheus.MustNewConstMetric(c.CPUThrottled, prometheus.CounterValue, metrics.Total.CPUThrottled)
+	ch <- prometheus.MustNewConstMetric(c.Pids, prometheus.GaugeValue, metrics.Total.Pids)
+	if *cgroupPerUser {
+		for uid, m := range metrics.Users {
+			user := userLabel(getUsername(uid, c.logger))
+			ch <- prometheus.MustNewConstMetric(c.UserMemoryCurrent, prometheus.GaugeValue, m.MemoryCurrent, user)
+			ch <- prometheus.MustNewConstMetric(c.UserMemoryMax, prometheus.GaugeValue, m.MemoryMax, user)
+			ch <- prometheus.MustNewConstMetric(c.UserMemoryEvents, prometheus.CounterValue, m.OOM, user, "oom")
+			ch <- prometheus.MustNewConstMetric(c.UserMemoryEvents, prometheus.CounterValue, m.OOMKill, user, "oom_kill")
+			ch <- prometheus.MustNewConstMetric(c.UserCPUSeconds, prometheus.CounterValue, m.CPUUser, user, "user")
+			ch <- prometheus.MustNewConstMetric(c.UserCPUSeconds, prometheus.CounterValue, m.CPUSystem, user, "system")
+			ch <- prometheus.MustNewConstMetric(c.UserCPUThrottled, prometheus.CounterValue, m.CPUThrottled, user)
+			ch <- prometheus.MustNewConstMetric(c.UserPids, prometheus.GaugeValue, m.Pids, user)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "cgroup")
+	return nil
+}
@@ -0,0 +1,203 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func setupCgroupFS() {
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	cgroupFS = filepath.Join(dir, "../fixtures/sys/fs/cgroup")
+}
+
+func TestGetCgroupsMetrics(t *testing.T) {
+	setupCgroupFS()
+	m, err := getCgroupsMetrics(getTestSnapshot(t), []string{"32666", "20821", "30001"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if val := m.Cgroups; val != 2 {
+		t.Errorf("Unexpected value for Cgroups, expected 2, got %v", val)
+	}
+	expectedUIDCgroups := map[string][]string{
+		"32666": {"/user.slice/user-32666.slice/ondemand-nginx.scope"},
+		"20821": {"/user.slice/user-20821.slice"},
+	}
+	if !reflect.DeepEqual(m.UIDCgroups, expectedUIDCgroups) {
+		t.Errorf("Unexpected UID cgroups\nExpected\n%v\nGot\n%v", expectedUIDCgroups, m.UIDCgroups)
+	}
+	expectedTotal := CgroupMetrics{MemoryCurrent: 1495269376, MemoryMax: 4294967296, OOM: 2, OOMKill: 1,
+		CPUUser: 800.123456, CPUSystem: 165, CPUThrottled: 3.5, Pids: 42}
+	if m.Total != expectedTotal {
+		t.Errorf("Unexpected total\nExpected\n%v\nGot\n%v", expectedTotal, m.Total)
+	}
+	// 20821 has no memory limit and the pids controller is not enabled
+	expectedUser := CgroupMetrics{MemoryCurrent: 1073741824, CPUUser: 100, CPUSystem: 20}
+	if val := m.Users["20821"]; val != expectedUser {
+		t.Errorf("Unexpected user metrics\nExpected\n%v\nGot\n%v", expectedUser, val)
+	}
+	if _, ok := m.Users["30001"]; ok {
+		t.Errorf("Unexpected user metrics for UID without cgroup v2")
+	}
+}
+
+func TestGetCgroupsMetricsNoCgroupV2(t *testing.T) {
+	cgroupFS = t.TempDir()
+	if _, err := getCgroupsMetrics(getTestSnapshot(t), []string{"32666"}, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error")
+	}
+	setupCgroupFS()
+	if _, err := getCgroupsMetrics(nil, []string{"32666"}, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error without snapshot")
+	}
+}
+
+func TestCgroupCollectorPerUser(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.cgroup", "--collector.cgroup.per-user"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = kingpin.CommandLine.Parse([]string{}) }()
+	lookupUserID = func(uid string) (*user.User, error) {
+		return &user.User{Uid: uid, Username: "msqueo"}, nil
+	}
+	userLookups = newUserLookupCache()
+	defer func() {
+		lookupUserID = user.LookupId
+		userLookups = newUserLookupCache()
+	}()
+	setupCgroupFS()
+	cgroupTracker = newCgroupCounterTracker()
+	defer func() { cgroupTracker = newCgroupCounterTracker() }()
+	expected := `
+		# HELP ondemand_pun_cgroup_memory_events_total Memory events of cgroups of PUNs
+		# TYPE ondemand_pun_cgroup_memory_events_total counter
+		ondemand_pun_cgroup_memory_events_total{type="oom"} 2
+		ondemand_pun_cgroup_memory_events_total{type="oom_kill"} 1
+		# HELP ondemand_pun_cgroup_memory_max_bytes Memory limit of cgroups of PUNs that have a limit
+		# TYPE ondemand_pun_cgroup_memory_max_bytes gauge
+		ondemand_pun_cgroup_memory_max_bytes 4294967296
+		# HELP ondemand_pun_cgroups Number of cgroups containing PUN processes
+		# TYPE ondemand_pun_cgroups gauge
+		ondemand_pun_cgroups 1
+		# HELP ondemand_pun_user_cgroup_cpu_seconds_total CPU time of the cgroups of a PUN
+		# TYPE ondemand_pun_user_cgroup_cpu_seconds_total counter
+		ondemand_pun_user_cgroup_cpu_seconds_total{mode="system",user="msqueo"} 145
+		ondemand_pun_user_cgroup_cpu_seconds_total{mode="user",user="msqueo"} 700.123456
+		# HELP ondemand_pun_user_cgroup_memory_current_bytes Memory used by the cgroups of a PUN
+		# TYPE ondemand_pun_user_cgroup_memory_current_bytes gauge
+		ondemand_pun_user_cgroup_memory_current_bytes{user="msqueo"} 421527552
+		# HELP ondemand_pun_user_cgroup_pids Number of processes in the cgroups of a PUN
+		# TYPE ondemand_pun_user_cgroup_pids gauge
+		ondemand_pun_user_cgroup_pids{user="msqueo"} 42
+	`
+	collector := NewCgroupCollector(promslog.NewNopLogger())
+	snapshot := getTestSnapshot(t)
+	c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666"}, ch) })
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_pun_cgroup_memory_events_total",
+		"ondemand_pun_cgroup_memory_max_bytes", "ondemand_pun_cgroups", "ondemand_pun_user_cgroup_cpu_seconds_total",
+		"ondemand_pun_user_cgroup_memory_current_bytes", "ondemand_pun_user_cgroup_pids"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	if val := testutil.CollectAndCount(c); val != 18 {
+		t.Errorf("Unexpected collection count %d, expected 18", val)
+	}
+}
+
+func TestCgroupCounterTracker(t *testing.T) {
+	tracker := newCgroupCounterTracker()
+	a := CgroupMetrics{MemoryCurrent: 100, OOMKill: 1, CPUUser: 10, Pids: 5}
+	b := CgroupMetrics{MemoryCurrent: 200, OOMKill: 2, CPUUser: 20, Pids: 3}
+	collection := func(paths map[string]CgroupMetrics, uids map[string][]string) CgroupsMetrics {
+		m := CgroupsMetrics{Users: make(map[string]CgroupMetrics), Paths: paths, UIDCgroups: uids}
+		for uid, ps := range uids {
+			var u CgroupMetrics
+			for _, p := range ps {
+				u.add(paths[p])
+				m.Total.add(paths[p])
+			}
+			m.Users[uid] = u
+		}
+		return m
+	}
+	m := collection(map[string]CgroupMetrics{"/a": a, "/b": b}, map[string][]string{"1": {"/a"}, "2": {"/b"}})
+	tracker.update(&m, []string{"1", "2"}, false)
+	if m.Total.OOMKill != 3 || m.Total.CPUUser != 30 {
+		t.Errorf("Unexpected totals %+v", m.Total)
+	}
+	// The cgroup of 2 is removed but 2 is still a PUN
+	m = collection(map[string]CgroupMetrics{"/a": a}, map[string][]string{"1": {"/a"}})
+	tracker.update(&m, []string{"1", "2"}, false)
+	if m.Total.OOMKill != 3 || m.Total.CPUUser != 30 || m.Total.MemoryCurrent != 100 || m.Total.Pids != 5 {
+		t.Errorf("Unexpected totals after cgroup removed %+v", m.Total)
+	}
+	if u := m.Users["2"]; u.OOMKill != 2 || u.MemoryCurrent != 0 {
+		t.Errorf("Unexpected user after cgroup removed %+v", u)
+	}
+	// The cgroup of 2 is recreated with counters starting again
+	m = collection(map[string]CgroupMetrics{"/a": a, "/b": {OOMKill: 1, CPUUser: 1}}, map[string][]string{"1": {"/a"}, "2": {"/b"}})
+	tracker.update(&m, []string{"1", "2"}, false)
+	if m.Total.OOMKill != 4 || m.Total.CPUUser != 31 {
+		t.Errorf("Unexpected totals after cgroup recreated %+v", m.Total)
+	}
+	// Partial results keep cgroups that were not seen
+	m = collection(map[string]CgroupMetrics{"/a": a}, map[string][]string{"1": {"/a"}})
+	tracker.update(&m, []string{"1", "2"}, true)
+	if m.Total.OOMKill != 4 || m.Total.CPUUser != 31 {
+		t.Errorf("Unexpected totals for partial results %+v", m.Total)
+	}
+	// 2 stops so its cgroup is only kept in the totals
+	m = collection(map[string]CgroupMetrics{"/a": a}, map[string][]string{"1": {"/a"}})
+	tracker.update(&m, []string{"1"}, false)
+	if m.Total.OOMKill != 4 || m.Total.CPUUser != 31 {
+		t.Errorf("Unexpected totals after PUN stopped %+v", m.Total)
+	}
+	if _, ok := m.Users["2"]; ok {
+		t.Errorf("Unexpected user of stopped PUN")
+	}
+}
+
+func TestReadCgroupValue(t *testing.T) {
+	setupCgroupFS()
+	value, err := readCgroupValue(filepath.Join(cgroupFS, "user.slice/user-20821.slice/memory.max"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if value != 0 {
+		t.Errorf("Unexpected value for max, expected 0, got %v", value)
+	}
+	if _, err := readCgroupValue(filepath.Join(cgroupFS, "cgroup.controllers")); err == nil {
+		t.Errorf("Expected error parsing non-numeric value")
+	}
+}
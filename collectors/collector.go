@@ -46,6 +46,10 @@ var (
 	useSudo         = kingpin.Flag("sudo", "Use sudo to execute commands").Default("true").Bool()
 	oodPortalPath   = "/etc/ood/config/ood_portal.yml"
 	execCommand     = exec.CommandContext
+	lookupUserID    = user.LookupId
+	lookupUser      = user.Lookup
+	lookupGroupID   = user.LookupGroupId
+	lookupGroupIDs  = (*user.User).GroupIds
 	timeNow         = getTimeNow
 	cores           = getCores
 	collectDuration = prometheus.NewDesc(
@@ -54,11 +58,22 @@ var (
 	collecTimeout = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "exporter", "collect_timeout"),
 		"Indicates the collector timed out", []string{"collector"}, nil)
+	collectPartial = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "collect_partial"),
+		"Indicates the collector returned partial results", []string{"collector"}, nil)
 	collecError = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "exporter", "collect_error"),
 		"Indicates the collector had an error", []string{"collector"}, nil)
+	procfsHidepid = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "procfs_hidepid"),
+		"The hidepid mode procfs is mounted with, 0 when processes of other users are visible", []string{"gid"}, nil)
+	punsNotVisible = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "exporter", "puns_not_visible"),
+		"Number of active PUNs without any process visible in procfs", nil, nil)
 )
 
+// Collector is created for every scrape, state kept between scrapes such as the
+// trackers of the collectors and the user lookup cache is held in package variables.
 type Collector struct {
 	sync.Mutex
 	ApacheStatus string
@@ -100,7 +115,7 @@ func getCores() int {
 func activePunArgs() (string, []string) {
 	var command string
 	var args []string
-	nginx_stage := "/opt/ood/nginx_stage/sbin/nginx_stage"
+	nginx_stage := *nginxStagePath
 	if *useSudo {
 		command = "sudo"
 		args = []string{nginx_stage}
@@ -111,13 +126,12 @@ func activePunArgs() (string, []string) {
 	return command, args
 }
 
-func getActivePuns(ctx context.Context, logger *slog.Logger) ([]string, []string, error) {
+func getActivePuns(ctx context.Context, logger *slog.Logger) ([]string, error) {
 	var puns []string
-	var punUIDs []string
 	command, args := activePunArgs()
 	out, err := execCommand(ctx, command, args...).Output()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	lines := strings.Split(string(out), "\n")
 	for _, l := range lines {
@@ -125,15 +139,18 @@ func getActivePuns(ctx context.Context, logger *slog.Logger) ([]string, []string
 			continue
 		}
 		puns = append(puns, l)
-		user, err := user.Lookup(l)
-		if err != nil {
-			logger.Error("Unable to lookup PUN username", "pun", l)
-			continue
-		}
-		punUIDs = append(punUIDs, user.Uid)
 	}
-	logger.Debug("Found PUNs", "puns", strings.Join(puns, ","), "punUIDs", strings.Join(punUIDs, ","))
-	return puns, punUIDs, nil
+	logger.Debug("Found PUNs with nginx_stage", "puns", strings.Join(puns, ","))
+	return puns, nil
+}
+
+func getUsername(uid string, logger *slog.Logger) string {
+	u, err := userLookups.lookup(context.Background(), userLookupUID, uid)
+	if err != nil {
+		logger.Debug("Unable to lookup username, using UID", "uid", uid, "err", err)
+		return uid
+	}
+	return u.Username
 }
 
 func NewCollector(logger *slog.Logger) *Collector {
@@ -145,10 +162,20 @@ func NewCollector(logger *slog.Logger) *Collector {
 
 func (c *Collector) collect(ch chan<- prometheus.Metric) error {
 	c.logger.Debug("Collecting metrics")
+	// The snapshot is read first as PUNs may be discovered from processes
+	snapshot := c.getProcessSnapshot(ch)
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*punsTimeout)*time.Second)
 	defer cancel()
 	collectTime := time.Now()
-	puns, punUIDs, err := getActivePuns(ctx, c.logger)
+	nginxStage, err := getNginxStageConfig(nginxStageConfigPath, c.logger)
+	if err != nil {
+		c.logger.Error("Unable to read nginx_stage.yml, using nginx_stage defaults", "file", nginxStageConfigPath, "err", err)
+	}
+	nginxStage.collect(ch)
+	// Usernames are also looked up by the other collectors
+	defer userLookups.collect(ch)
+	discovery, err := discoverPuns(ctx, snapshot, nginxStage, c.logger)
 	if ctx.Err() == context.DeadlineExceeded {
 		ch <- prometheus.MustNewConstMetric(collecTimeout, prometheus.GaugeValue, 1, "puns")
 		c.logger.Error("Timeout collecting PUNs")
@@ -161,15 +188,25 @@ func (c *Collector) collect(ch chan<- prometheus.Metric) error {
 		return nil
 	}
 	ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 0, "puns")
-	ch <- prometheus.MustNewConstMetric(c.ActivePuns, prometheus.GaugeValue, float64(len(puns)))
+	ch <- prometheus.MustNewConstMetric(c.ActivePuns, prometheus.GaugeValue, float64(len(discovery.Puns)))
+	for mode, puns := range discovery.Modes {
+		ch <- prometheus.MustNewConstMetric(discoveryPunsDesc, prometheus.GaugeValue, float64(len(puns)), mode)
+	}
+	if len(getDiscoveryModes()) > 1 {
+		ch <- prometheus.MustNewConstMetric(discoveryMismatch, prometheus.GaugeValue, float64(discovery.Mismatches()))
+	}
 	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "puns")
+	punUIDs := discovery.PunUIDs
+	punLifecycle.update(discovery.Puns, getPunMasters(snapshot), timeNow()).collect(ch)
+
+	c.collectProcfsVisibility(snapshot, punUIDs, ch)
 
 	wg := &sync.WaitGroup{}
 	wg.Add(3)
 
 	go func(puns []string) {
 		p := NewProcessCollector(c.logger.With("collector", "process"))
-		err := p.collect(puns, ch)
+		err := p.collect(snapshot, puns, ch)
 		if err != nil {
 			c.logger.Error("Error collecting process information", "err", err)
 			ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 1, "process")
@@ -191,9 +228,9 @@ func (c *Collector) collect(ch chan<- prometheus.Metric) error {
 		wg.Done()
 	}()
 
+	passenger := NewPassengerCollector(c.logger)
 	go func(puns []string) {
-		p := NewPassengerCollector(c.logger)
-		err := p.collect(puns, ch)
+		err := passenger.collect(snapshot, puns, nginxStage, ch)
 		if err != nil {
 			c.logger.Error("Error collecting passenger information", "err", err)
 			ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 1, "passenger")
@@ -202,10 +239,119 @@ func (c *Collector) collect(ch chan<- prometheus.Metric) error {
 		}
 		wg.Done()
 	}(punUIDs)
+
+	if *cgroupEnabled {
+		wg.Add(1)
+		go func(puns []string) {
+			cg := NewCgroupCollector(c.logger.With("collector", "cgroup"))
+			err := cg.collect(snapshot, puns, ch)
+			if err != nil {
+				c.logger.Error("Error collecting cgroup information", "err", err)
+				ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 1, "cgroup")
+			} else {
+				ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 0, "cgroup")
+			}
+			wg.Done()
+		}(punUIDs)
+	}
+	if *oomEnabled {
+		wg.Add(1)
+		go func(puns []string) {
+			o := NewOOMCollector(c.logger.With("collector", "oom"))
+			err := o.collect(snapshot, puns, ch)
+			if err != nil {
+				c.logger.Error("Error collecting OOM kill information", "err", err)
+				ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 1, "oom")
+			} else {
+				ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 0, "oom")
+			}
+			wg.Done()
+		}(punUIDs)
+	}
+	if *groupsEnabled {
+		wg.Add(1)
+		go func(users map[string]string) {
+			g := NewGroupCollector(c.logger.With("collector", "groups"))
+			err := g.collect(snapshot, users, ch)
+			if err != nil {
+				c.logger.Error("Error collecting group information", "err", err)
+				ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 1, "groups")
+			} else {
+				ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 0, "groups")
+			}
+			wg.Done()
+		}(discovery.Users)
+	}
 	wg.Wait()
+
+	// Idle PUNs are determined from the Passenger requests of the Passenger collector
+	idle := NewIdleCollector(c.logger.With("collector", "idle"))
+	if err := idle.collect(snapshot, discovery.Users, passenger.requests, nginxStage, ch); err != nil {
+		c.logger.Error("Error collecting idle PUN information", "err", err)
+		ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 1, "idle")
+	} else {
+		ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 0, "idle")
+	}
 	return nil
 }
 
+// getProcessSnapshot reads procfs once for all collectors, a partial snapshot
+// is still used when reading procfs times out.
+func (c *Collector) getProcessSnapshot(ch chan<- prometheus.Metric) *ProcessSnapshot {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*processTimeout)*time.Second)
+	defer cancel()
+	snapshot, err := newProcessSnapshot(ctx, c.logger.With("collector", "procfs"))
+	if snapshot != nil {
+		ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, snapshot.Duration.Seconds(), "procfs")
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		ch <- prometheus.MustNewConstMetric(collecTimeout, prometheus.GaugeValue, 1, "procfs")
+		ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 0, "procfs")
+		c.logger.Error("Timeout reading procfs, using partial process snapshot")
+		return snapshot
+	}
+	ch <- prometheus.MustNewConstMetric(collecTimeout, prometheus.GaugeValue, 0, "procfs")
+	if err != nil {
+		ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 1, "procfs")
+		c.logger.Error("Error reading procfs", "err", err)
+		return nil
+	}
+	ch <- prometheus.MustNewConstMetric(collecError, prometheus.GaugeValue, 0, "procfs")
+	return snapshot
+}
+
+// collectProcfsVisibility reports if procfs hides the processes of PUNs from the exporter,
+// such as when mounted with hidepid or from another PID namespace.
+func (c *Collector) collectProcfsVisibility(snapshot *ProcessSnapshot, puns []string, ch chan<- prometheus.Metric) {
+	mode, gid, err := getHidepid(mountinfoPath, procFS)
+	if err != nil {
+		c.logger.Debug("Unable to determine procfs hidepid mode", "path", procFS, "err", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(procfsHidepid, prometheus.GaugeValue, mode, gid)
+		if mode > 0 && os.Geteuid() != 0 {
+			c.logger.Warn("procfs is mounted with hidepid, processes of PUNs are hidden unless the exporter runs as root or in the gid group", "path", procFS, "hidepid", mode, "gid", gid)
+		}
+	}
+	// Processes may be missing from partial snapshots
+	if snapshot == nil || snapshot.Partial {
+		return
+	}
+	visible := make(map[string]struct{})
+	for _, p := range snapshot.Procs {
+		visible[p.UID] = struct{}{}
+	}
+	var notVisible float64
+	for _, uid := range puns {
+		if _, ok := visible[uid]; !ok {
+			notVisible++
+		}
+	}
+	if notVisible > 0 {
+		c.logger.Warn("Active PUNs have no process visible in procfs", "path", procFS, "puns", notVisible)
+	}
+	ch <- prometheus.MustNewConstMetric(punsNotVisible, prometheus.GaugeValue, notVisible)
+}
+
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.ActivePuns
 }
@@ -217,3 +363,36 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		c.logger.Error("Error scraping ondemand", "err", err)
 	}
 }
+
+// Histogram holds cumulative observations for a constant histogram.
+type Histogram struct {
+	Count   uint64
+	Sum     float64
+	Buckets map[float64]uint64
+}
+
+func newHistogram(buckets []float64) Histogram {
+	h := Histogram{Buckets: make(map[float64]uint64)}
+	for _, b := range buckets {
+		h.Buckets[b] = 0
+	}
+	return h
+}
+
+func (h *Histogram) observe(value float64) {
+	h.Count++
+	h.Sum += value
+	for b := range h.Buckets {
+		if value <= b {
+			h.Buckets[b]++
+		}
+	}
+}
+
+func (h Histogram) copy() Histogram {
+	c := Histogram{Count: h.Count, Sum: h.Sum, Buckets: make(map[float64]uint64)}
+	for b, v := range h.Buckets {
+		c.Buckets[b] = v
+	}
+	return c
+}
@@ -50,6 +50,17 @@ var (
 	ctx, _           = context.WithTimeout(context.Background(), 5*time.Second)
 )
 
+// funcCollector is a prometheus.Collector collecting with a function, used to test the collect methods of collectors.
+type funcCollector func(ch chan<- prometheus.Metric)
+
+func (f funcCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(f, ch)
+}
+
+func (f funcCollector) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
 func fakeExecCommand(ctx context.Context, command string, args ...string) *exec.Cmd {
 	cs := []string{"-test.run=TestExecCommandHelper", "--", command}
 	cs = append(cs, args...)
@@ -108,7 +119,7 @@ foo
 bar`
 	expPuns := []string{"foo", "bar"}
 	defer func() { execCommand = exec.CommandContext }()
-	puns, _, err := getActivePuns(ctx, promslog.NewNopLogger())
+	puns, err := getActivePuns(ctx, promslog.NewNopLogger())
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 		return
@@ -162,6 +173,21 @@ bar`
 	cores = func() int {
 		return 1
 	}
+	passengerTracker = newPassengerProcessTracker()
+	processIOTracker = newProcessIOCounterTracker()
+	punLifecycle = newPunLifecycleTracker()
+	punIdle = newPunIdleTracker()
+	userLookups = newUserLookupCache()
+	procFS = filepath.Join(dir, "../fixtures/proc")
+	cgroupFS = filepath.Join(dir, "../fixtures/sys/fs/cgroup")
+	nginxStageConfigPath = filepath.Join(dir, "../fixtures/nginx_stage.yml")
+	defer func() { nginxStageConfigPath = "/etc/ood/config/nginx_stage.yml" }()
+	mountinfo := filepath.Join(t.TempDir(), "mountinfo")
+	if err := os.WriteFile(mountinfo, []byte(fmt.Sprintf("25 30 0:23 / %s rw,nosuid,nodev,noexec,relatime shared:13 - proc proc rw,hidepid=invisible,gid=1000\n", procFS)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mountinfoPath = mountinfo
+	defer func() { mountinfoPath = "/proc/self/mountinfo" }()
 	expected := `
 		# HELP ondemand_active_puns Active PUNs
 		# TYPE ondemand_active_puns gauge
@@ -172,46 +198,154 @@ bar`
 		# HELP ondemand_exporter_collect_error Indicates the collector had an error
 		# TYPE ondemand_exporter_collect_error gauge
 		ondemand_exporter_collect_error{collector="apache"} 0
+		ondemand_exporter_collect_error{collector="idle"} 0
 		ondemand_exporter_collect_error{collector="passenger"} 0
 		ondemand_exporter_collect_error{collector="process"} 0
+		ondemand_exporter_collect_error{collector="procfs"} 0
 		ondemand_exporter_collect_error{collector="puns"} 0
 		# HELP ondemand_node_apps Number of running NodeJS apps
 		# TYPE ondemand_node_apps gauge
 		ondemand_node_apps 0
+		# HELP ondemand_passenger_info Number of Passenger instances running a Passenger version
+		# TYPE ondemand_passenger_info gauge
+		ondemand_passenger_info{version="6.0.4"} 2
 		# HELP ondemand_passenger_instances Number of Passenger instances
 		# TYPE ondemand_passenger_instances gauge
 		ondemand_passenger_instances 2
+		# HELP ondemand_passenger_instance_errors Number of Passenger instances that could not be collected
+		# TYPE ondemand_passenger_instance_errors gauge
+		ondemand_passenger_instance_errors{reason="parse"} 0
+		ondemand_passenger_instance_errors{reason="query"} 0
+		ondemand_passenger_instance_errors{reason="timeout"} 0
 		# HELP ondemand_passenger_app_average_runtime_seconds Average runtime in seconds of passenger apps
 		# TYPE ondemand_passenger_app_average_runtime_seconds gauge
-		ondemand_passenger_app_average_runtime_seconds{app="/var/www/ood/apps/sys/dashboard"} 36369
-		ondemand_passenger_app_average_runtime_seconds{app="/var/www/ood/apps/sys/files"} 36799
+		ondemand_passenger_app_average_runtime_seconds{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 36369
+		ondemand_passenger_app_average_runtime_seconds{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 36799
+		# HELP ondemand_passenger_app_info Information about passenger apps
+		# TYPE ondemand_passenger_app_info gauge
+		ondemand_passenger_app_info{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",environment="production",spawn_method="direct"} 1
+		ondemand_passenger_app_info{app="/var/www/ood/apps/sys/files",app_type="nodejs",environment="production",spawn_method="direct"} 1
 		# HELP ondemand_passenger_app_count Count of passenger instances of an app
 		# TYPE ondemand_passenger_app_count gauge
-		ondemand_passenger_app_count{app="/var/www/ood/apps/sys/dashboard"} 2
-		ondemand_passenger_app_count{app="/var/www/ood/apps/sys/files"} 1
+		ondemand_passenger_app_count{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 2
+		ondemand_passenger_app_count{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 1
+		# HELP ondemand_passenger_app_context_switches_total Context switches of passenger app processes
+		# TYPE ondemand_passenger_app_context_switches_total counter
+		ondemand_passenger_app_context_switches_total{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",type="nonvoluntary"} 150
+		ondemand_passenger_app_context_switches_total{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",type="voluntary"} 2000
+		ondemand_passenger_app_context_switches_total{app="/var/www/ood/apps/sys/files",app_type="nodejs",type="nonvoluntary"} 20
+		ondemand_passenger_app_context_switches_total{app="/var/www/ood/apps/sys/files",app_type="nodejs",type="voluntary"} 500
+		# HELP ondemand_passenger_app_cpu_seconds_total CPU time in seconds of passenger app processes
+		# TYPE ondemand_passenger_app_cpu_seconds_total counter
+		ondemand_passenger_app_cpu_seconds_total{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 18
+		ondemand_passenger_app_cpu_seconds_total{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 2.5
+		# HELP ondemand_passenger_app_read_bytes_total Bytes read from storage by passenger app processes
+		# TYPE ondemand_passenger_app_read_bytes_total counter
+		ondemand_passenger_app_read_bytes_total{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 4096000
+		ondemand_passenger_app_read_bytes_total{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 1024000
+		# HELP ondemand_passenger_app_write_bytes_total Bytes written to storage by passenger app processes
+		# TYPE ondemand_passenger_app_write_bytes_total counter
+		ondemand_passenger_app_write_bytes_total{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 81920
+		ondemand_passenger_app_write_bytes_total{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 0
 		# HELP ondemand_passenger_app_cpu_percent CPU percent of passenger apps
 		# TYPE ondemand_passenger_app_cpu_percent gauge
-		ondemand_passenger_app_cpu_percent{app="/var/www/ood/apps/sys/dashboard"} 2
-		ondemand_passenger_app_cpu_percent{app="/var/www/ood/apps/sys/files"} 0
+		ondemand_passenger_app_cpu_percent{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 2
+		ondemand_passenger_app_cpu_percent{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 0
 		# HELP ondemand_passenger_app_processes Process count of an app
 		# TYPE ondemand_passenger_app_processes gauge
-		ondemand_passenger_app_processes{app="/var/www/ood/apps/sys/dashboard"} 2
-		ondemand_passenger_app_processes{app="/var/www/ood/apps/sys/files"} 1
+		ondemand_passenger_app_processes{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 2
+		ondemand_passenger_app_processes{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 1
 		# HELP ondemand_passenger_app_real_memory_bytes Real memory of passenger apps
 		# TYPE ondemand_passenger_app_real_memory_bytes gauge
-		ondemand_passenger_app_real_memory_bytes{app="/var/www/ood/apps/sys/dashboard"} 187949056
-		ondemand_passenger_app_real_memory_bytes{app="/var/www/ood/apps/sys/files"} 42954752
+		ondemand_passenger_app_real_memory_bytes{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 187949056
+		ondemand_passenger_app_real_memory_bytes{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 42954752
 		# HELP ondemand_passenger_app_requests_total Requests made to passenger apps
 		# TYPE ondemand_passenger_app_requests_total counter
-		ondemand_passenger_app_requests_total{app="/var/www/ood/apps/sys/dashboard"} 342
-		ondemand_passenger_app_requests_total{app="/var/www/ood/apps/sys/files"} 10
+		ondemand_passenger_app_requests_total{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 342
+		ondemand_passenger_app_requests_total{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 10
+		# HELP ondemand_passenger_app_processes_exited_total Passenger processes of an app that exited
+		# TYPE ondemand_passenger_app_processes_exited_total counter
+		ondemand_passenger_app_processes_exited_total{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 0
+		ondemand_passenger_app_processes_exited_total{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 0
+		# HELP ondemand_passenger_app_processes_spawned_total Passenger processes spawned for an app
+		# TYPE ondemand_passenger_app_processes_spawned_total counter
+		ondemand_passenger_app_processes_spawned_total{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 2
+		ondemand_passenger_app_processes_spawned_total{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 1
+		# HELP ondemand_passenger_app_idle_processes Passenger app processes not used within the idle threshold
+		# TYPE ondemand_passenger_app_idle_processes gauge
+		ondemand_passenger_app_idle_processes{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 2
+		ondemand_passenger_app_idle_processes{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 1
+		# HELP ondemand_passenger_app_seconds_since_last_used Seconds since a passenger app process was last used
+		# TYPE ondemand_passenger_app_seconds_since_last_used gauge
+		ondemand_passenger_app_seconds_since_last_used{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 34536
+		ondemand_passenger_app_seconds_since_last_used{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 36787
+		# HELP ondemand_passenger_app_spawn_duration_seconds Time taken to spawn passenger app processes
+		# TYPE ondemand_passenger_app_spawn_duration_seconds histogram
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="0.5"} 0
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="1"} 0
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="2"} 2
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="5"} 2
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="10"} 2
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="20"} 2
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="30"} 2
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="60"} 2
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="90"} 2
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/dashboard",app_type="ruby",le="+Inf"} 2
+		ondemand_passenger_app_spawn_duration_seconds_sum{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 3.587005
+		ondemand_passenger_app_spawn_duration_seconds_count{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 2
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="0.5"} 0
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="1"} 0
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="2"} 1
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="5"} 1
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="10"} 1
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="20"} 1
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="30"} 1
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="60"} 1
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="90"} 1
+		ondemand_passenger_app_spawn_duration_seconds_bucket{app="/var/www/ood/apps/sys/files",app_type="nodejs",le="+Inf"} 1
+		ondemand_passenger_app_spawn_duration_seconds_sum{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 1.11186
+		ondemand_passenger_app_spawn_duration_seconds_count{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 1
 		# HELP ondemand_passenger_app_rss_bytes RSS of passenger apps
 		# TYPE ondemand_passenger_app_rss_bytes gauge
-		ondemand_passenger_app_rss_bytes{app="/var/www/ood/apps/sys/dashboard"} 202727424
-		ondemand_passenger_app_rss_bytes{app="/var/www/ood/apps/sys/files"} 56840192
+		ondemand_passenger_app_rss_bytes{app="/var/www/ood/apps/sys/dashboard",app_type="ruby"} 202727424
+		ondemand_passenger_app_rss_bytes{app="/var/www/ood/apps/sys/files",app_type="nodejs"} 56840192
+		# HELP ondemand_exporter_procfs_hidepid The hidepid mode procfs is mounted with, 0 when processes of other users are visible
+		# TYPE ondemand_exporter_procfs_hidepid gauge
+		ondemand_exporter_procfs_hidepid{gid="1000"} 2
+		# HELP ondemand_exporter_puns_not_visible Number of active PUNs without any process visible in procfs
+		# TYPE ondemand_exporter_puns_not_visible gauge
+		ondemand_exporter_puns_not_visible 0
+		# HELP ondemand_nginx_stage_info Settings of nginx_stage.yml
+		# TYPE ondemand_nginx_stage_info gauge
+		ondemand_nginx_stage_info{nginx_file_upload_max="10737420000",passenger_pool_idle_time="600",pun_config_path="/var/lib/ondemand-nginx/config/puns/%{user}.conf",pun_pid_path="/run/ondemand-nginx/%{user}/passenger.pid",pun_socket_path="/run/ondemand-nginx/%{user}/passenger.sock"} 1
+		# HELP ondemand_idle_pun_memory_bytes RSS of the processes of idle PUNs
+		# TYPE ondemand_idle_pun_memory_bytes gauge
+		ondemand_idle_pun_memory_bytes 0
+		# HELP ondemand_idle_puns Number of PUNs without Passenger requests, CPU usage or Apache connections within the idle window
+		# TYPE ondemand_idle_puns gauge
+		ondemand_idle_puns 0
+		# HELP ondemand_pun_starts_total Number of PUNs started since the exporter started
+		# TYPE ondemand_pun_starts_total counter
+		ondemand_pun_starts_total 0
+		# HELP ondemand_pun_stops_total Number of PUNs stopped since the exporter started
+		# TYPE ondemand_pun_stops_total counter
+		ondemand_pun_stops_total 0
+		# HELP ondemand_pun_discovery_puns Number of PUNs found by a discovery mode
+		# TYPE ondemand_pun_discovery_puns gauge
+		ondemand_pun_discovery_puns{mode="nginx_stage"} 2
+		# HELP ondemand_host_memory_bytes Total and available memory of the host
+		# TYPE ondemand_host_memory_bytes gauge
+		ondemand_host_memory_bytes{type="available"} 14354100224
+		ondemand_host_memory_bytes{type="total"} 16637542400
+		# HELP ondemand_hung_puns Number of PUNs with a process in uninterruptible sleep longer than the threshold
+		# TYPE ondemand_hung_puns gauge
+		ondemand_hung_puns 0
 		# HELP ondemand_pun_cpu_time CPU time of all PUNs
 		# TYPE ondemand_pun_cpu_time gauge
 		ondemand_pun_cpu_time 0
+		# HELP ondemand_pun_fd_utilization_ratio Highest ratio of open file descriptors to the soft limit of any PUN process
+		# TYPE ondemand_pun_fd_utilization_ratio gauge
+		ondemand_pun_fd_utilization_ratio 0
 		# HELP ondemand_pun_memory Memory used by all PUNs
 		# TYPE ondemand_pun_memory gauge
 		ondemand_pun_memory{type="rss"} 0
@@ -219,6 +353,15 @@ bar`
 		# HELP ondemand_pun_memory_percent Percent memory of all PUNs
 		# TYPE ondemand_pun_memory_percent gauge
 		ondemand_pun_memory_percent 0
+		# HELP ondemand_pun_open_fds Number of open file descriptors of all PUN processes
+		# TYPE ondemand_pun_open_fds gauge
+		ondemand_pun_open_fds 0
+		# HELP ondemand_pun_read_bytes_total Bytes read from storage by PUN processes
+		# TYPE ondemand_pun_read_bytes_total counter
+		ondemand_pun_read_bytes_total 0
+		# HELP ondemand_pun_write_bytes_total Bytes written to storage by PUN processes
+		# TYPE ondemand_pun_write_bytes_total counter
+		ondemand_pun_write_bytes_total 0
 		# HELP ondemand_rack_apps Number of running Rack apps
 		# TYPE ondemand_rack_apps gauge
 		ondemand_rack_apps 0
@@ -237,15 +380,20 @@ bar`
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 37 {
-		t.Errorf("Unexpected collection count %d, expected 37", val)
+	} else if val != 171 {
+		t.Errorf("Unexpected collection count %d, expected 171", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "ondemand_active_puns", "ondemand_exporter_collect_error",
 		"ondemand_client_connections", "ondemand_unique_client_connections", "ondemand_unique_websocket_clients", "ondemand_websocket_connections",
 		"ondemand_node_apps", "ondemand_rack_apps", "ondemand_pun_cpu_time", "ondemand_pun_memory", "ondemand_pun_memory_percent",
-		"ondemand_passenger_instances", "ondemand_passenger_app_count", "ondemand_passenger_app_processes",
+		"ondemand_pun_open_fds", "ondemand_pun_fd_utilization_ratio", "ondemand_pun_read_bytes_total", "ondemand_pun_write_bytes_total",
+		"ondemand_exporter_procfs_hidepid", "ondemand_exporter_puns_not_visible", "ondemand_pun_discovery_puns", "ondemand_pun_starts_total", "ondemand_pun_stops_total", "ondemand_idle_puns", "ondemand_idle_pun_memory_bytes", "ondemand_nginx_stage_info", "ondemand_host_memory_bytes", "ondemand_hung_puns", "ondemand_passenger_info", "ondemand_passenger_instances", "ondemand_passenger_instance_errors", "ondemand_passenger_app_info", "ondemand_passenger_app_count", "ondemand_passenger_app_processes",
 		"ondemand_passenger_app_rss_bytes", "ondemand_passenger_app_real_memory_bytes", "ondemand_passenger_app_cpu_percent",
-		"ondemand_passenger_app_requests_total", "ondemand_passenger_app_average_runtime_seconds"); err != nil {
+		"ondemand_passenger_app_requests_total", "ondemand_passenger_app_average_runtime_seconds",
+		"ondemand_passenger_app_processes_spawned_total", "ondemand_passenger_app_processes_exited_total",
+		"ondemand_passenger_app_spawn_duration_seconds", "ondemand_passenger_app_seconds_since_last_used", "ondemand_passenger_app_idle_processes",
+		"ondemand_passenger_app_cpu_seconds_total", "ondemand_passenger_app_read_bytes_total", "ondemand_passenger_app_write_bytes_total",
+		"ondemand_passenger_app_context_switches_total"); err != nil {
 		t.Errorf("unexpected collecting result:\n%s", err)
 	}
 }
@@ -295,8 +443,10 @@ bar`
 		# HELP ondemand_exporter_collect_error Indicates the collector had an error
 		# TYPE ondemand_exporter_collect_error gauge
 		ondemand_exporter_collect_error{collector="apache"} 0
+		ondemand_exporter_collect_error{collector="idle"} 0
 		ondemand_exporter_collect_error{collector="passenger"} 0
 		ondemand_exporter_collect_error{collector="process"} 0
+		ondemand_exporter_collect_error{collector="procfs"} 0
 		ondemand_exporter_collect_error{collector="puns"} 0
 		# HELP ondemand_passenger_instances Number of Passenger instances
 		# TYPE ondemand_passenger_instances gauge
@@ -306,8 +456,8 @@ bar`
 	gatherers := setupGatherer(collector)
 	if val, err := testutil.GatherAndCount(gatherers); err != nil {
 		t.Errorf("Unexpected error: %v", err)
-	} else if val != 23 {
-		t.Errorf("Unexpected collection count %d, expected 23", val)
+	} else if val != 133 {
+		t.Errorf("Unexpected collection count %d, expected 133", val)
 	}
 	if err := testutil.GatherAndCompare(gatherers, strings.NewReader(expected), "ondemand_exporter_collect_error",
 		"ondemand_passenger_instances", "ondemand_passenger_app_count", "ondemand_passenger_app_processes",
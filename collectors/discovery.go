@@ -0,0 +1,190 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	discoveryNginxStage = "nginx_stage"
+	discoveryPidFile    = "pid_file"
+	discoveryProcess    = "process"
+	punUserPlaceholder  = "%{user}"
+)
+
+var (
+	punsDiscovery = kingpin.Flag("collector.puns.discovery", "How to discover PUNs, one of nginx_stage, pid_file or process, may be repeated to compare modes").Default(discoveryNginxStage).Envar("PUNS_DISCOVERY").Enums(discoveryNginxStage, discoveryPidFile, discoveryProcess)
+	punPidPath    = kingpin.Flag("collector.puns.pid-path", "Path of the PUN nginx pid file used by pid_file discovery, %{user} is replaced by the PUN user, defaults to pun_pid_path of nginx_stage.yml").Envar("PUNS_PID_PATH").String()
+	punSocketPath = kingpin.Flag("collector.puns.socket-path", "Path of the PUN socket used by pid_file discovery when the pid file can not be read, %{user} is replaced by the PUN user, defaults to pun_socket_path of nginx_stage.yml").Envar("PUNS_SOCKET_PATH").String()
+	// nginx_stage starts the PUN nginx master with the user in the process title
+	punNginxMaster    = regexp.MustCompile(`^nginx: master process \(([^)]+)\)`)
+	discoveryPunsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pun_discovery", "puns"),
+		"Number of PUNs found by a discovery mode", []string{"mode"}, nil)
+	discoveryMismatch = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pun_discovery", "mismatches"),
+		"Number of PUNs not found by every discovery mode", nil, nil)
+)
+
+// PunDiscovery are the PUNs found by each discovery mode, Users maps PUN UIDs to usernames.
+type PunDiscovery struct {
+	Puns    []string
+	PunUIDs []string
+	Users   map[string]string
+	Modes   map[string][]string
+}
+
+// Mismatches returns the number of PUNs that were not found by every mode.
+func (d PunDiscovery) Mismatches() int {
+	var mismatches int
+	for _, pun := range d.Puns {
+		for _, puns := range d.Modes {
+			if !slices.Contains(puns, pun) {
+				mismatches++
+				break
+			}
+		}
+	}
+	return mismatches
+}
+
+// getDiscoveryModes returns the enabled discovery modes without duplicates.
+func getDiscoveryModes() []string {
+	return slices.Compact(slices.Sorted(slices.Values(*punsDiscovery)))
+}
+
+// discoverPuns finds PUNs with every enabled mode, returning an error only if every mode fails.
+func discoverPuns(ctx context.Context, snapshot *ProcessSnapshot, config NginxStageConfig, logger *slog.Logger) (PunDiscovery, error) {
+	discovery := PunDiscovery{Users: make(map[string]string), Modes: make(map[string][]string)}
+	var errs []error
+	for _, mode := range getDiscoveryModes() {
+		var puns []string
+		var err error
+		switch mode {
+		case discoveryNginxStage:
+			puns, err = getActivePuns(ctx, logger)
+		case discoveryPidFile:
+			puns, err = getPidFilePuns(config.pidPath(), config.socketPath(), logger)
+		case discoveryProcess:
+			puns, err = getProcessPuns(snapshot)
+		}
+		if err != nil {
+			logger.Error("Unable to discover PUNs", "mode", mode, "err", err)
+			errs = append(errs, fmt.Errorf("%s: %w", mode, err))
+			continue
+		}
+		discovery.Modes[mode] = puns
+		for _, pun := range puns {
+			if !slices.Contains(discovery.Puns, pun) {
+				discovery.Puns = append(discovery.Puns, pun)
+			}
+		}
+	}
+	if len(discovery.Modes) == 0 {
+		return discovery, errors.Join(errs...)
+	}
+	for i, result := range userLookups.lookupUsers(ctx, discovery.Puns) {
+		if result.Err != nil {
+			logger.Error("Unable to lookup PUN username", "pun", discovery.Puns[i], "err", result.Err)
+			continue
+		}
+		discovery.PunUIDs = append(discovery.PunUIDs, result.User.Uid)
+		discovery.Users[result.User.Uid] = discovery.Puns[i]
+	}
+	logger.Debug("Discovered PUNs", "puns", strings.Join(discovery.Puns, ","), "punUIDs", strings.Join(discovery.PunUIDs, ","))
+	return discovery, nil
+}
+
+// getPidFilePuns returns the users with a running PUN nginx pid file or, failing that, a PUN socket.
+func getPidFilePuns(pidPath string, socketPath string, logger *slog.Logger) ([]string, error) {
+	pidPath = rootfsFilePath(pidPath)
+	prefix, suffix, ok := strings.Cut(pidPath, punUserPlaceholder)
+	if !ok {
+		return nil, fmt.Errorf("PUN pid path %s does not contain %s", pidPath, punUserPlaceholder)
+	}
+	matches, err := filepath.Glob(prefix + "*" + suffix)
+	if err != nil {
+		return nil, err
+	}
+	var puns []string
+	for _, match := range matches {
+		pun := strings.TrimSuffix(strings.TrimPrefix(match, prefix), suffix)
+		if pun == "" || strings.Contains(pun, "/") {
+			continue
+		}
+		running, err := pidFileRunning(match)
+		if err != nil {
+			socket := rootfsFilePath(strings.ReplaceAll(socketPath, punUserPlaceholder, pun))
+			logger.Debug("Unable to read PUN pid file, checking socket", "pun", pun, "path", match, "socket", socket, "err", err)
+			_, err = os.Stat(socket)
+			running = err == nil
+		}
+		if !running {
+			logger.Debug("Skip PUN with stale pid file", "pun", pun, "path", match)
+			continue
+		}
+		puns = append(puns, pun)
+	}
+	return puns, nil
+}
+
+// pidFileRunning returns true if the process of the pid file exists in procfs.
+func pidFileRunning(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false, fmt.Errorf("invalid pid file %s: %w", path, err)
+	}
+	if _, err := os.Stat(filepath.Join(procFS, strconv.Itoa(pid))); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// getProcessPuns returns the users of PUN nginx master processes in the snapshot.
+func getProcessPuns(snapshot *ProcessSnapshot) ([]string, error) {
+	if snapshot == nil {
+		return nil, errors.New("no procfs snapshot")
+	}
+	return slices.Sorted(maps.Keys(getPunMasters(snapshot))), nil
+}
@@ -0,0 +1,173 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/common/promslog"
+)
+
+// setupPunRunDir creates PUN pid files and sockets like nginx_stage in a temporary directory
+// and returns the pid and socket path templates.
+func setupPunRunDir(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	files := map[string]string{
+		// nginx master of msqueo is in the procfs fixtures
+		"msqueo/passenger.pid": "71825\n",
+		// Stale pid file of a PUN that was killed
+		"stale/passenger.pid": "99999\n",
+		"sock/passenger.sock": "",
+		"nosock/.keep":        "",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Pid files that can not be read fall back to the socket
+	for _, pun := range []string{"sock", "nosock"} {
+		if err := os.Mkdir(filepath.Join(dir, pun, "passenger.pid"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "%{user}/passenger.pid"), filepath.Join(dir, "%{user}/passenger.sock")
+}
+
+func TestGetPidFilePuns(t *testing.T) {
+	getTestSnapshot(t)
+	pidPath, socketPath := setupPunRunDir(t)
+	puns, err := getPidFilePuns(pidPath, socketPath, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	slices.Sort(puns)
+	expected := []string{"msqueo", "sock"}
+	if !reflect.DeepEqual(puns, expected) {
+		t.Errorf("Unexpected PUNs\nExpected\n%v\nGot\n%v", expected, puns)
+	}
+	if _, err := getPidFilePuns("/var/run/ondemand-nginx/passenger.pid", socketPath, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error for pid path without user")
+	}
+}
+
+func TestGetProcessPuns(t *testing.T) {
+	puns, err := getProcessPuns(getTestSnapshot(t))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := []string{"msqueo"}
+	if !reflect.DeepEqual(puns, expected) {
+		t.Errorf("Unexpected PUNs\nExpected\n%v\nGot\n%v", expected, puns)
+	}
+	if _, err := getProcessPuns(nil); err == nil {
+		t.Errorf("Expected error without snapshot")
+	}
+}
+
+func TestDiscoverPuns(t *testing.T) {
+	snapshot := getTestSnapshot(t)
+	pidPath, socketPath := setupPunRunDir(t)
+	args := []string{"--collector.puns.discovery=nginx_stage", "--collector.puns.discovery=pid_file", "--collector.puns.discovery=process"}
+	config := defaultNginxStageConfig
+	config.PunPidPath = pidPath
+	config.PunSocketPath = socketPath
+	*punsDiscovery = nil
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		*punsDiscovery = nil
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	execCommand = fakeExecCommand
+	mockedStdout = "msqueo\ntdockendorf"
+	defer func() { execCommand = exec.CommandContext }()
+	lookupUser = func(username string) (*user.User, error) {
+		uids := map[string]string{"msqueo": "32666", "tdockendorf": "20821", "sock": "30001"}
+		return &user.User{Uid: uids[username], Username: username}, nil
+	}
+	userLookups = newUserLookupCache()
+	defer func() {
+		lookupUser = user.Lookup
+		userLookups = newUserLookupCache()
+	}()
+	d, err := discoverPuns(context.Background(), snapshot, config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expectedModes := map[string][]string{
+		"nginx_stage": {"msqueo", "tdockendorf"},
+		"pid_file":    {"msqueo", "sock"},
+		"process":     {"msqueo"},
+	}
+	slices.Sort(d.Modes["pid_file"])
+	if !reflect.DeepEqual(d.Modes, expectedModes) {
+		t.Errorf("Unexpected modes\nExpected\n%v\nGot\n%v", expectedModes, d.Modes)
+	}
+	if expected := []string{"32666", "20821", "30001"}; !reflect.DeepEqual(d.PunUIDs, expected) {
+		t.Errorf("Unexpected PUN UIDs\nExpected\n%v\nGot\n%v", expected, d.PunUIDs)
+	}
+	if val := d.Mismatches(); val != 2 {
+		t.Errorf("Unexpected mismatches, expected 2, got %d", val)
+	}
+	// PUNs are still discovered when nginx_stage fails
+	mockedExitStatus = 1
+	defer func() { mockedExitStatus = 0 }()
+	d, err = discoverPuns(context.Background(), snapshot, config, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, ok := d.Modes["nginx_stage"]; ok {
+		t.Errorf("Unexpected nginx_stage PUNs after error")
+	}
+	if val := len(d.Puns); val != 2 {
+		t.Errorf("Unexpected number of PUNs, expected 2, got %d", val)
+	}
+}
+
+func TestDiscoverPunsError(t *testing.T) {
+	*punsDiscovery = nil
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.puns.discovery=process"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		*punsDiscovery = nil
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	if _, err := discoverPuns(context.Background(), nil, defaultNginxStageConfig, promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error when every discovery mode fails")
+	}
+}
@@ -0,0 +1,150 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	groupsEnabled   = kingpin.Flag("collector.groups", "Enable collecting PUN metrics by the groups of PUN users").Default("false").Envar("GROUPS_ENABLED").Bool()
+	groupsAllowlist = kingpin.Flag("collector.groups.allowlist", "Group whose members are counted in addition to the primary group of PUN users, may be repeated").PlaceHolder("GROUP").Envar("GROUPS_ALLOWLIST").Strings()
+)
+
+type GroupCollector struct {
+	ActivePuns *prometheus.Desc
+	CPUTime    *prometheus.Desc
+	Memory     *prometheus.Desc
+	logger     *slog.Logger
+}
+
+// GroupMetrics are the PUNs of the users of a group and their processes.
+type GroupMetrics struct {
+	Puns      float64
+	CPUTime   float64
+	MemoryRSS float64
+	MemoryVMS float64
+}
+
+// getPunGroups returns the primary and allowlisted group names of each PUN by UID.
+func getPunGroups(ctx context.Context, users map[string]string, allowlist []string, logger *slog.Logger) map[string][]string {
+	groups := make(map[string][]string)
+	for uid, username := range users {
+		u, err := userLookups.lookup(ctx, userLookupName, username)
+		if err != nil {
+			logger.Error("Unable to lookup PUN username", "pun", username, "err", err)
+			continue
+		}
+		gids := []string{u.Gid}
+		if len(allowlist) > 0 {
+			member, err := userLookups.lookupGroupIDs(ctx, u)
+			if err != nil {
+				logger.Error("Unable to lookup groups of PUN user", "pun", username, "err", err)
+			}
+			gids = append(gids, member...)
+		}
+		for i, gid := range gids {
+			name := gid
+			if g, err := userLookups.lookupGroup(ctx, gid); err != nil {
+				logger.Debug("Unable to lookup group, using GID", "gid", gid, "err", err)
+			} else {
+				name = g.Name
+			}
+			// Only the primary group is counted for groups not in the allowlist
+			if i > 0 && !slices.Contains(allowlist, name) && !slices.Contains(allowlist, gid) {
+				continue
+			}
+			// User private groups are named after the user
+			if name == username {
+				name = userLabel(name)
+			}
+			if !slices.Contains(groups[uid], name) {
+				groups[uid] = append(groups[uid], name)
+			}
+		}
+	}
+	return groups
+}
+
+// getGroupMetrics sums the PUNs and their processes by group, a PUN is counted in every one of its groups.
+func getGroupMetrics(snapshot *ProcessSnapshot, punGroups map[string][]string) map[string]GroupMetrics {
+	metrics := make(map[string]GroupMetrics)
+	for _, groups := range punGroups {
+		for _, group := range groups {
+			m := metrics[group]
+			m.Puns++
+			metrics[group] = m
+		}
+	}
+	if snapshot == nil {
+		return metrics
+	}
+	for _, p := range snapshot.Procs {
+		for _, group := range punGroups[p.UID] {
+			m := metrics[group]
+			m.CPUTime = m.CPUTime + p.Stat.CPUTime()
+			m.MemoryRSS = m.MemoryRSS + float64(p.Stat.ResidentMemory())
+			m.MemoryVMS = m.MemoryVMS + float64(p.Stat.VirtualMemory())
+			metrics[group] = m
+		}
+	}
+	return metrics
+}
+
+func NewGroupCollector(logger *slog.Logger) *GroupCollector {
+	return &GroupCollector{
+		logger:     logger,
+		ActivePuns: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "active_puns_by_group"), "Active PUNs by group of the PUN user", []string{"group"}, nil),
+		CPUTime:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_group", "cpu_seconds"), "CPU time in seconds of PUN processes by group of the PUN user", []string{"group"}, nil),
+		Memory:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_group", "memory_bytes"), "Memory used by PUN processes by group of the PUN user", []string{"group", "type"}, nil),
+	}
+}
+
+// collect reports the PUNs of users by UID by group, the processes of PUNs are not reported without a procfs snapshot.
+func (c *GroupCollector) collect(snapshot *ProcessSnapshot, users map[string]string, ch chan<- prometheus.Metric) error {
+	c.logger.Debug("Collecting group metrics")
+	collectTime := time.Now()
+	punGroups := getPunGroups(context.Background(), users, *groupsAllowlist, c.logger)
+	metrics := getGroupMetrics(snapshot, punGroups)
+	for group, m := range metrics {
+		ch <- prometheus.MustNewConstMetric(c.ActivePuns, prometheus.GaugeValue, m.Puns, group)
+		if snapshot == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.CPUTime, prometheus.GaugeValue, m.CPUTime, group)
+		ch <- prometheus.MustNewConstMetric(c.Memory, prometheus.GaugeValue, m.MemoryRSS, group, "rss")
+		ch <- prometheus.MustNewConstMetric(c.Memory, prometheus.GaugeValue, m.MemoryVMS, group, "vms")
+	}
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "groups")
+	if snapshot == nil {
+		return errors.New("no procfs snapshot")
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"os/user"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func mockGroupLookups(t *testing.T) {
+	t.Helper()
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	lookupUser = func(username string) (*user.User, error) {
+		users := map[string]*user.User{
+			"msqueo":      {Uid: "32666", Gid: "32666", Username: "msqueo"},
+			"tdockendorf": {Uid: "20821", Gid: "5509", Username: "tdockendorf"},
+		}
+		if u, ok := users[username]; ok {
+			return u, nil
+		}
+		return nil, user.UnknownUserError(username)
+	}
+	lookupGroupID = func(gid string) (*user.Group, error) {
+		groups := map[string]string{"32666": "PZS0002", "5509": "PZS0708", "10": "wheel"}
+		if name, ok := groups[gid]; ok {
+			return &user.Group{Gid: gid, Name: name}, nil
+		}
+		return nil, user.UnknownGroupIdError(gid)
+	}
+	lookupGroupIDs = func(u *user.User) ([]string, error) {
+		members := map[string][]string{"msqueo": {"32666", "5509", "10"}, "tdockendorf": {"5509", "10", "7000"}}
+		return members[u.Username], nil
+	}
+	userLookups = newUserLookupCache()
+	t.Cleanup(func() {
+		lookupUser = user.Lookup
+		lookupGroupID = user.LookupGroupId
+		lookupGroupIDs = (*user.User).GroupIds
+		userLookups = newUserLookupCache()
+	})
+}
+
+func TestGetPunGroups(t *testing.T) {
+	mockGroupLookups(t)
+	users := map[string]string{"32666": "msqueo", "20821": "tdockendorf", "30001": "unknown"}
+	groups := getPunGroups(context.Background(), users, nil, promslog.NewNopLogger())
+	expected := map[string][]string{"32666": {"PZS0002"}, "20821": {"PZS0708"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Unexpected groups\nExpected\n%v\nGot\n%v", expected, groups)
+	}
+	groups = getPunGroups(context.Background(), users, []string{"PZS0708", "7000"}, promslog.NewNopLogger())
+	expected = map[string][]string{"32666": {"PZS0002", "PZS0708"}, "20821": {"PZS0708", "7000"}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("Unexpected groups with allowlist\nExpected\n%v\nGot\n%v", expected, groups)
+	}
+	// Group lookups are cached
+	lookupGroupID = func(gid string) (*user.Group, error) {
+		t.Errorf("Unexpected group lookup of %s", gid)
+		return nil, user.UnknownGroupIdError(gid)
+	}
+	_ = getPunGroups(context.Background(), users, []string{"PZS0708"}, promslog.NewNopLogger())
+}
+
+func TestGroupCollector(t *testing.T) {
+	mockGroupLookups(t)
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.groups.allowlist=PZS0708"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		*groupsAllowlist = nil
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	expected := `
+		# HELP ondemand_active_puns_by_group Active PUNs by group of the PUN user
+		# TYPE ondemand_active_puns_by_group gauge
+		ondemand_active_puns_by_group{group="PZS0002"} 1
+		ondemand_active_puns_by_group{group="PZS0708"} 2
+		# HELP ondemand_pun_group_cpu_seconds CPU time in seconds of PUN processes by group of the PUN user
+		# TYPE ondemand_pun_group_cpu_seconds gauge
+		ondemand_pun_group_cpu_seconds{group="PZS0002"} 1.3499999999999999
+		ondemand_pun_group_cpu_seconds{group="PZS0708"} 9.95
+		# HELP ondemand_pun_group_memory_bytes Memory used by PUN processes by group of the PUN user
+		# TYPE ondemand_pun_group_memory_bytes gauge
+		ondemand_pun_group_memory_bytes{group="PZS0002",type="rss"} 3.7564416e+07
+		ondemand_pun_group_memory_bytes{group="PZS0002",type="vms"} 2.157719552e+09
+		ondemand_pun_group_memory_bytes{group="PZS0708",type="rss"} 3.38735104e+08
+		ondemand_pun_group_memory_bytes{group="PZS0708",type="vms"} 4.490481664e+09
+	`
+	users := map[string]string{"32666": "msqueo", "20821": "tdockendorf"}
+	g := NewGroupCollector(promslog.NewNopLogger())
+	snapshot := getTestSnapshot(t)
+	collector := funcCollector(func(ch chan<- prometheus.Metric) { _ = g.collect(snapshot, users, ch) })
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"ondemand_active_puns_by_group", "ondemand_pun_group_cpu_seconds", "ondemand_pun_group_memory_bytes"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	snapshot = nil
+	if val := testutil.CollectAndCount(collector, "ondemand_pun_group_memory_bytes"); val != 0 {
+		t.Errorf("Unexpected group memory series without snapshot: %d", val)
+	}
+	if val := testutil.CollectAndCount(collector, "ondemand_active_puns_by_group"); val != 2 {
+		t.Errorf("Unexpected active PUNs by group series without snapshot: %d", val)
+	}
+}
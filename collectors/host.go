@@ -0,0 +1,85 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"log/slog"
+	"math"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/procfs"
+)
+
+var (
+	hostMemoryReserve = kingpin.Flag("collector.process.memory-reserve", "Fraction of MemTotal kept available when estimating how many more PUNs fit in memory").Default("0.1").Envar("PROCESS_MEMORY_RESERVE").Float64()
+	// Resources of /proc/pressure that are reported
+	pressureResources = []string{"cpu", "memory", "io"}
+)
+
+// HostMetrics are the memory and pressure stall information of the host.
+type HostMetrics struct {
+	MemoryTotal     float64
+	MemoryAvailable float64
+	Pressure        map[string]PressureMetrics
+}
+
+// PressureMetrics are the some and full pressure of a resource, Full is nil when not reported.
+type PressureMetrics struct {
+	Some *procfs.PSILine
+	Full *procfs.PSILine
+}
+
+// getHostMetrics reads MemAvailable and /proc/pressure, leaving out resources without PSI.
+func getHostMetrics(fs procfs.FS, meminfo procfs.Meminfo, logger *slog.Logger) HostMetrics {
+	metrics := HostMetrics{Pressure: make(map[string]PressureMetrics)}
+	if meminfo.MemTotal != nil {
+		metrics.MemoryTotal = float64(*meminfo.MemTotal) * 1024
+	}
+	if meminfo.MemAvailable != nil {
+		metrics.MemoryAvailable = float64(*meminfo.MemAvailable) * 1024
+	}
+	for _, resource := range pressureResources {
+		psi, err := fs.PSIStatsForResource(resource)
+		if err != nil {
+			logger.Debug("Unable to get pressure stall information", "resource", resource, "err", err)
+			continue
+		}
+		if psi.Some == nil && psi.Full == nil {
+			continue
+		}
+		metrics.Pressure[resource] = PressureMetrics{Some: psi.Some, Full: psi.Full}
+	}
+	return metrics
+}
+
+// punCapacity returns how many more PUNs of average memory fit while keeping reserve of total memory available.
+func punCapacity(host HostMetrics, average float64, reserve float64) float64 {
+	if average <= 0 {
+		return 0
+	}
+	headroom := host.MemoryAvailable - reserve*host.MemoryTotal
+	if headroom <= 0 {
+		return 0
+	}
+	return math.Floor(headroom / average)
+}
@@ -0,0 +1,156 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/procfs"
+)
+
+func TestGetHostMetrics(t *testing.T) {
+	getTestSnapshot(t)
+	fs, err := procfs.NewFS(procFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meminfo, err := fs.Meminfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := getHostMetrics(fs, meminfo, promslog.NewNopLogger())
+	if val := m.MemoryTotal; val != 16637542400 {
+		t.Errorf("Unexpected value for MemoryTotal, expected 16637542400, got %v", val)
+	}
+	if val := m.MemoryAvailable; val != 14354100224 {
+		t.Errorf("Unexpected value for MemoryAvailable, expected 14354100224, got %v", val)
+	}
+	if val := len(m.Pressure); val != 3 {
+		t.Errorf("Unexpected number of pressure resources, expected 3, got %v", val)
+	}
+	if val := m.Pressure["memory"].Full.Avg60; val != 0.4 {
+		t.Errorf("Unexpected value for memory full avg60, expected 0.4, got %v", val)
+	}
+}
+
+func TestGetHostMetricsNoPressure(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "meminfo"), []byte("MemTotal: 1024 kB\nMemAvailable: 512 kB\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fs, err := procfs.NewFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meminfo, err := fs.Meminfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := getHostMetrics(fs, meminfo, promslog.NewNopLogger())
+	if val := len(m.Pressure); val != 0 {
+		t.Errorf("Unexpected pressure without PSI: %v", m.Pressure)
+	}
+	if val := m.MemoryAvailable; val != 524288 {
+		t.Errorf("Unexpected value for MemoryAvailable, expected 524288, got %v", val)
+	}
+}
+
+func TestPunCapacity(t *testing.T) {
+	host := HostMetrics{MemoryTotal: 1000, MemoryAvailable: 450}
+	tests := []struct {
+		average  float64
+		reserve  float64
+		expected float64
+	}{
+		{average: 100, reserve: 0.1, expected: 3},
+		{average: 100, reserve: 0, expected: 4},
+		{average: 100, reserve: 0.5, expected: 0},
+		{average: 0, reserve: 0.1, expected: 0},
+	}
+	for _, test := range tests {
+		if val := punCapacity(host, test.average, test.reserve); val != test.expected {
+			t.Errorf("Unexpected capacity for average %v reserve %v, expected %v, got %v", test.average, test.reserve, test.expected, val)
+		}
+	}
+}
+
+func TestProcessCollectorHost(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+		# HELP ondemand_host_pressure_ratio Ratio of time tasks were stalled on a resource averaged over a window
+		# TYPE ondemand_host_pressure_ratio gauge
+		ondemand_host_pressure_ratio{resource="cpu",type="full",window="10s"} 0
+		ondemand_host_pressure_ratio{resource="cpu",type="full",window="300s"} 0
+		ondemand_host_pressure_ratio{resource="cpu",type="full",window="60s"} 0
+		ondemand_host_pressure_ratio{resource="cpu",type="some",window="10s"} 0.0125
+		ondemand_host_pressure_ratio{resource="cpu",type="some",window="300s"} 0.001
+		ondemand_host_pressure_ratio{resource="cpu",type="some",window="60s"} 0.005
+		ondemand_host_pressure_ratio{resource="io",type="full",window="10s"} 0.0025
+		ondemand_host_pressure_ratio{resource="io",type="full",window="300s"} 0.0005
+		ondemand_host_pressure_ratio{resource="io",type="full",window="60s"} 0.001
+		ondemand_host_pressure_ratio{resource="io",type="some",window="10s"} 0.0075
+		ondemand_host_pressure_ratio{resource="io",type="some",window="300s"} 0.002
+		ondemand_host_pressure_ratio{resource="io",type="some",window="60s"} 0.003
+		ondemand_host_pressure_ratio{resource="memory",type="full",window="10s"} 0.01
+		ondemand_host_pressure_ratio{resource="memory",type="full",window="300s"} 0.0005
+		ondemand_host_pressure_ratio{resource="memory",type="full",window="60s"} 0.004
+		ondemand_host_pressure_ratio{resource="memory",type="some",window="10s"} 0.025
+		ondemand_host_pressure_ratio{resource="memory",type="some",window="300s"} 0.0025
+		ondemand_host_pressure_ratio{resource="memory",type="some",window="60s"} 0.01
+		# HELP ondemand_host_pressure_stalled_seconds_total Time tasks were stalled on a resource
+		# TYPE ondemand_host_pressure_stalled_seconds_total counter
+		ondemand_host_pressure_stalled_seconds_total{resource="cpu",type="full"} 0
+		ondemand_host_pressure_stalled_seconds_total{resource="cpu",type="some"} 12.345678
+		ondemand_host_pressure_stalled_seconds_total{resource="io",type="full"} 3
+		ondemand_host_pressure_stalled_seconds_total{resource="io",type="some"} 9
+		ondemand_host_pressure_stalled_seconds_total{resource="memory",type="full"} 1.5
+		ondemand_host_pressure_stalled_seconds_total{resource="memory",type="some"} 4.5
+		# HELP ondemand_pun_capacity_remaining Estimated number of additional PUNs that fit in available memory
+		# TYPE ondemand_pun_capacity_remaining gauge
+		ondemand_pun_capacity_remaining 74
+		# HELP ondemand_pun_memory_average_bytes Average memory used by a PUN
+		# TYPE ondemand_pun_memory_average_bytes gauge
+		ondemand_pun_memory_average_bytes 1.69367552e+08
+	`
+	collector := NewProcessCollector(promslog.NewNopLogger())
+	snapshot := getTestSnapshot(t)
+	c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666", "20821"}, ch) })
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_host_pressure_ratio",
+		"ondemand_host_pressure_stalled_seconds_total", "ondemand_pun_capacity_remaining", "ondemand_pun_memory_average_bytes"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	// Without PUN processes there is no average to estimate capacity from
+	c = funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"99999"}, ch) })
+	if n := testutil.CollectAndCount(c, "ondemand_pun_capacity_remaining", "ondemand_pun_memory_average_bytes"); n != 0 {
+		t.Errorf("Unexpected capacity metrics without PUN processes: %d", n)
+	}
+}
@@ -0,0 +1,190 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/procfs"
+)
+
+const (
+	// State of a connected socket in /proc/net/unix
+	unixStateConnected = 3
+)
+
+var (
+	idleWindow       = kingpin.Flag("collector.idle.window", "Duration without Passenger requests, CPU usage or Apache connections after which a PUN is idle").Default("1h").Envar("IDLE_WINDOW").Duration()
+	idleCPUThreshold = kingpin.Flag("collector.idle.cpu-threshold", "CPU seconds per second the processes of an idle PUN may use").Default("0.01").Envar("IDLE_CPU_THRESHOLD").Float64()
+	punIdle          = newPunIdleTracker()
+)
+
+type IdleCollector struct {
+	IdlePuns   *prometheus.Desc
+	IdleMemory *prometheus.Desc
+	logger     *slog.Logger
+}
+
+// PunActivity is what a PUN is doing at a collection, RequestsOK is false when its requests are unknown.
+type PunActivity struct {
+	Requests    int
+	RequestsOK  bool
+	CPUTime     float64
+	Connections int
+	MemoryRSS   float64
+}
+
+type punIdleState struct {
+	requests   int
+	requestsOK bool
+	cpuTime    float64
+	seen       time.Time
+	active     time.Time
+}
+
+// punIdleTracker remembers when PUNs were last active.
+type punIdleTracker struct {
+	sync.Mutex
+	puns map[string]punIdleState
+}
+
+func newPunIdleTracker() *punIdleTracker {
+	return &punIdleTracker{
+		puns: make(map[string]punIdleState),
+	}
+}
+
+// update records the activity of PUNs by UID and returns the UIDs of PUNs idle for the window.
+func (t *punIdleTracker) update(activity map[string]PunActivity, now time.Time, window time.Duration, cpuThreshold float64) []string {
+	t.Lock()
+	defer t.Unlock()
+	var idle []string
+	puns := make(map[string]punIdleState)
+	for uid, a := range activity {
+		state := punIdleState{requests: a.Requests, requestsOK: a.RequestsOK, cpuTime: a.CPUTime, seen: now, active: now}
+		previous, ok := t.puns[uid]
+		if ok {
+			active := a.Connections > 0
+			if a.RequestsOK && previous.requestsOK && a.Requests > previous.requests {
+				active = true
+			}
+			if elapsed := now.Sub(previous.seen).Seconds(); elapsed > 0 && (a.CPUTime-previous.cpuTime)/elapsed > cpuThreshold {
+				active = true
+			}
+			if !a.RequestsOK {
+				state.requests = previous.requests
+				state.requestsOK = previous.requestsOK
+			}
+			if !active {
+				state.active = previous.active
+			}
+		}
+		if now.Sub(state.active) >= window {
+			idle = append(idle, uid)
+		}
+		puns[uid] = state
+	}
+	t.puns = puns
+	return idle
+}
+
+// getPunActivity returns the activity of each PUN by UID, requests is nil when unknown for every PUN.
+func getPunActivity(snapshot *ProcessSnapshot, users map[string]string, requests map[string]int, socketPath string, logger *slog.Logger) (map[string]PunActivity, error) {
+	if snapshot == nil {
+		return nil, errors.New("no procfs snapshot")
+	}
+	// CPU time of processes missing from a partial snapshot would look like activity in the next collection
+	if snapshot.Partial {
+		return nil, errors.New("partial procfs snapshot")
+	}
+	activity := make(map[string]PunActivity)
+	sockets := make(map[string]string)
+	for uid, user := range users {
+		a := PunActivity{}
+		a.Requests, a.RequestsOK = requests[uid]
+		activity[uid] = a
+		sockets[strings.ReplaceAll(socketPath, punUserPlaceholder, user)] = uid
+	}
+	for _, p := range snapshot.Procs {
+		a, ok := activity[p.UID]
+		if !ok {
+			continue
+		}
+		a.CPUTime = a.CPUTime + p.Stat.CPUTime()
+		a.MemoryRSS = a.MemoryRSS + float64(p.Stat.ResidentMemory())
+		activity[p.UID] = a
+	}
+	fs, err := procfs.NewFS(procFS)
+	if err != nil {
+		return nil, err
+	}
+	unix, err := fs.NetUNIX()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range unix.Rows {
+		uid, ok := sockets[line.Path]
+		if !ok || uint64(line.State) != unixStateConnected {
+			continue
+		}
+		a := activity[uid]
+		a.Connections++
+		activity[uid] = a
+	}
+	for uid, a := range activity {
+		logger.Debug("PUN activity", "uid", uid, "requests", a.Requests, "cputime", a.CPUTime, "connections", a.Connections)
+	}
+	return activity, nil
+}
+
+func NewIdleCollector(logger *slog.Logger) *IdleCollector {
+	return &IdleCollector{
+		logger:     logger,
+		IdlePuns:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "idle_puns"), "Number of PUNs without Passenger requests, CPU usage or Apache connections within the idle window", nil, nil),
+		IdleMemory: prometheus.NewDesc(prometheus.BuildFQName(namespace, "idle_pun", "memory_bytes"), "RSS of the processes of idle PUNs", nil, nil),
+	}
+}
+
+func (c *IdleCollector) collect(snapshot *ProcessSnapshot, users map[string]string, requests map[string]int, config NginxStageConfig, ch chan<- prometheus.Metric) error {
+	c.logger.Debug("Collecting idle PUN metrics")
+	collectTime := time.Now()
+	activity, err := getPunActivity(snapshot, users, requests, config.socketPath(), c.logger)
+	if err != nil {
+		return err
+	}
+	idle := punIdle.update(activity, timeNow(), *idleWindow, *idleCPUThreshold)
+	var memory float64
+	for _, uid := range idle {
+		memory = memory + activity[uid].MemoryRSS
+	}
+	ch <- prometheus.MustNewConstMetric(c.IdlePuns, prometheus.GaugeValue, float64(len(idle)))
+	ch <- prometheus.MustNewConstMetric(c.IdleMemory, prometheus.GaugeValue, memory)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "idle")
+	return nil
+}
@@ -0,0 +1,177 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestPunIdleTracker(t *testing.T) {
+	tracker := newPunIdleTracker()
+	now := time.Unix(10000, 0)
+	window := time.Hour
+	// PUNs seen for the first time are active
+	idle := tracker.update(map[string]PunActivity{"1": {Requests: 5, RequestsOK: true, CPUTime: 10}}, now, window, 0.01)
+	if len(idle) != 0 {
+		t.Errorf("Unexpected idle PUNs on first collection: %v", idle)
+	}
+	// Small CPU usage does not make a PUN active
+	now = now.Add(window)
+	idle = tracker.update(map[string]PunActivity{"1": {Requests: 5, RequestsOK: true, CPUTime: 11}}, now, window, 0.01)
+	if len(idle) != 1 || idle[0] != "1" {
+		t.Errorf("Unexpected idle PUNs after window without activity: %v", idle)
+	}
+	// Unknown requests keep the previous count so later requests are still seen
+	now = now.Add(time.Minute)
+	idle = tracker.update(map[string]PunActivity{"1": {CPUTime: 11}}, now, window, 0.01)
+	if len(idle) != 1 {
+		t.Errorf("Unexpected idle PUNs with unknown requests: %v", idle)
+	}
+	now = now.Add(time.Minute)
+	idle = tracker.update(map[string]PunActivity{"1": {Requests: 6, RequestsOK: true, CPUTime: 11}}, now, window, 0.01)
+	if len(idle) != 0 {
+		t.Errorf("Unexpected idle PUNs after request: %v", idle)
+	}
+	// Connections and CPU usage above the threshold are activity
+	now = now.Add(window)
+	idle = tracker.update(map[string]PunActivity{
+		"1": {Requests: 6, RequestsOK: true, CPUTime: 11, Connections: 1},
+		"2": {Requests: 0, RequestsOK: true, CPUTime: 0},
+	}, now, window, 0.01)
+	if len(idle) != 0 {
+		t.Errorf("Unexpected idle PUNs with connection: %v", idle)
+	}
+	now = now.Add(window)
+	idle = tracker.update(map[string]PunActivity{
+		"1": {Requests: 6, RequestsOK: true, CPUTime: 11},
+		"2": {Requests: 0, RequestsOK: true, CPUTime: 100},
+	}, now, window, 0.01)
+	if len(idle) != 1 || idle[0] != "1" {
+		t.Errorf("Unexpected idle PUNs with CPU usage: %v", idle)
+	}
+}
+
+func TestGetPunActivity(t *testing.T) {
+	snapshot := getTestSnapshot(t)
+	users := map[string]string{"32666": "msqueo", "20821": "tdockendorf"}
+	requests := map[string]int{"32666": 7}
+	activity, err := getPunActivity(snapshot, users, requests, "/var/run/ondemand-nginx/%{user}/passenger.sock", promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	msqueo := activity["32666"]
+	if msqueo.Connections != 2 {
+		t.Errorf("Unexpected connections for msqueo, expected 2, got %d", msqueo.Connections)
+	}
+	if !msqueo.RequestsOK || msqueo.Requests != 7 {
+		t.Errorf("Unexpected requests for msqueo: %v %d", msqueo.RequestsOK, msqueo.Requests)
+	}
+	if msqueo.CPUTime == 0 || msqueo.MemoryRSS == 0 {
+		t.Errorf("Unexpected CPU time %v or RSS %v for msqueo", msqueo.CPUTime, msqueo.MemoryRSS)
+	}
+	tdockendorf := activity["20821"]
+	if tdockendorf.Connections != 0 {
+		t.Errorf("Unexpected connections for tdockendorf, expected 0, got %d", tdockendorf.Connections)
+	}
+	if tdockendorf.RequestsOK {
+		t.Errorf("Unexpected requests for tdockendorf")
+	}
+	if _, err := getPunActivity(nil, users, requests, "", promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error without snapshot")
+	}
+	snapshot.Partial = true
+	if _, err := getPunActivity(snapshot, users, requests, "", promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error with partial snapshot")
+	}
+}
+
+func TestPassengerUserRequests(t *testing.T) {
+	instances := []PassengerInstance{
+		{PID: "1", UID: "100"},
+		{PID: "2", UID: "200"},
+		{PID: "3", UID: "300"},
+	}
+	metrics := []PassengerAppMetrics{
+		{UID: "100", Processes: []PassengerProcessMetrics{{RequestsProcessed: 2}, {RequestsProcessed: 3}}},
+		{UID: "100", Processes: []PassengerProcessMetrics{{RequestsProcessed: 1}}},
+		{UID: "300", Processes: []PassengerProcessMetrics{{RequestsProcessed: 4}}},
+	}
+	requests := passengerUserRequests(instances, []string{"3"}, metrics)
+	if val := requests["100"]; val != 6 {
+		t.Errorf("Unexpected requests for 100, expected 6, got %d", val)
+	}
+	if val, ok := requests["200"]; !ok || val != 0 {
+		t.Errorf("Unexpected requests for 200, expected 0, got %d", val)
+	}
+	if _, ok := requests["300"]; ok {
+		t.Errorf("Unexpected requests for failed instance")
+	}
+}
+
+func TestIdleCollector(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	punIdle = newPunIdleTracker()
+	defer func() { punIdle = newPunIdleTracker() }()
+	snapshot := getTestSnapshot(t)
+	users := map[string]string{"32666": "msqueo", "20821": "tdockendorf"}
+	activity, err := getPunActivity(snapshot, users, nil, "", promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	mockNow, _ := time.Parse("01/02/2006", "04/17/2020")
+	defer func() { timeNow = getTimeNow }()
+	timeNow = func() time.Time {
+		return mockNow
+	}
+	// Seed the tracker as if both PUNs were last active two hours ago, only msqueo has Apache connections since
+	punIdle.update(map[string]PunActivity{
+		"32666": {Requests: 7, RequestsOK: true, CPUTime: activity["32666"].CPUTime},
+		"20821": {Requests: 0, RequestsOK: true, CPUTime: activity["20821"].CPUTime},
+	}, mockNow.Add(-2*time.Hour), *idleWindow, *idleCPUThreshold)
+	expected := `
+		# HELP ondemand_idle_pun_memory_bytes RSS of the processes of idle PUNs
+		# TYPE ondemand_idle_pun_memory_bytes gauge
+		ondemand_idle_pun_memory_bytes 3.01170688e+08
+		# HELP ondemand_idle_puns Number of PUNs without Passenger requests, CPU usage or Apache connections within the idle window
+		# TYPE ondemand_idle_puns gauge
+		ondemand_idle_puns 1
+	`
+	config := defaultNginxStageConfig
+	config.PunSocketPath = "/var/run/ondemand-nginx/%{user}/passenger.sock"
+	idle := NewIdleCollector(promslog.NewNopLogger())
+	collector := funcCollector(func(ch chan<- prometheus.Metric) {
+		_ = idle.collect(snapshot, users, map[string]int{"32666": 7, "20821": 0}, config, ch)
+	})
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "ondemand_idle_puns", "ondemand_idle_pun_memory_bytes"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
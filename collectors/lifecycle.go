@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	punLifecycle  = newPunLifecycleTracker()
+	punAgeBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400, 259200, 604800}
+	punAge        = prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "age_seconds"),
+		"Age of PUNs since the PUN nginx master process started", nil, nil)
+	punStarts = prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "starts_total"),
+		"Number of PUNs started since the exporter started", nil, nil)
+	punStops = prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "stops_total"),
+		"Number of PUNs stopped since the exporter started", nil, nil)
+)
+
+// PunLifecycleMetrics are the PUN starts and stops since the last collection and the ages of PUNs.
+type PunLifecycleMetrics struct {
+	Starts float64
+	Stops  float64
+	Ages   Histogram
+}
+
+// punLifecycleTracker remembers the nginx master start time of PUNs, 0 when the master was not found.
+type punLifecycleTracker struct {
+	sync.Mutex
+	initialized bool
+	starts      map[string]float64
+	started     float64
+	stopped     float64
+}
+
+func newPunLifecycleTracker() *punLifecycleTracker {
+	return &punLifecycleTracker{
+		starts: make(map[string]float64),
+	}
+}
+
+// update records the current PUNs and counts restarts as a stop and a start.
+func (t *punLifecycleTracker) update(puns []string, masters map[string]float64, now time.Time) PunLifecycleMetrics {
+	t.Lock()
+	defer t.Unlock()
+	starts := make(map[string]float64)
+	for _, pun := range puns {
+		start, ok := masters[pun]
+		previous, known := t.starts[pun]
+		if !ok {
+			start = previous
+		}
+		starts[pun] = start
+		if !t.initialized {
+			continue
+		}
+		if !known {
+			t.started++
+		} else if ok && previous != 0 && previous != start {
+			t.stopped++
+			t.started++
+		}
+	}
+	if t.initialized {
+		for pun := range t.starts {
+			if _, ok := starts[pun]; !ok {
+				t.stopped++
+			}
+		}
+	}
+	t.starts = starts
+	t.initialized = true
+	metrics := PunLifecycleMetrics{Starts: t.started, Stops: t.stopped, Ages: newHistogram(punAgeBuckets)}
+	for _, start := range starts {
+		if start == 0 {
+			continue
+		}
+		metrics.Ages.observe(max(float64(now.Unix())-start, 0))
+	}
+	return metrics
+}
+
+// getPunMasters returns the start time of the nginx master process of each PUN in the snapshot.
+func getPunMasters(snapshot *ProcessSnapshot) map[string]float64 {
+	masters := make(map[string]float64)
+	if snapshot == nil {
+		return masters
+	}
+	for _, p := range snapshot.Procs {
+		match := punNginxMaster.FindStringSubmatch(strings.Join(p.Cmdline, " "))
+		if match == nil {
+			continue
+		}
+		masters[match[1]] = p.StartTime
+	}
+	return masters
+}
+
+func (m PunLifecycleMetrics) collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(punStarts, prometheus.CounterValue, m.Starts)
+	ch <- prometheus.MustNewConstMetric(punStops, prometheus.CounterValue, m.Stops)
+	ch <- prometheus.MustNewConstHistogram(punAge, m.Ages.Count, m.Ages.Sum, m.Ages.Buckets)
+}
@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGetPunMasters(t *testing.T) {
+	masters := getPunMasters(getTestSnapshot(t))
+	if val := len(masters); val != 1 {
+		t.Fatalf("Unexpected number of PUN masters, expected 1, got %d: %v", val, masters)
+	}
+	if val := fmt.Sprintf("%.2f", masters["msqueo"]); val != "1587044261.61" {
+		t.Errorf("Unexpected start time of msqueo, expected 1587044261.61, got %s", val)
+	}
+	if val := len(getPunMasters(nil)); val != 0 {
+		t.Errorf("Unexpected PUN masters without snapshot: %d", val)
+	}
+}
+
+func TestPunLifecycleTracker(t *testing.T) {
+	tracker := newPunLifecycleTracker()
+	now := time.Unix(10000, 0)
+	// PUNs running when the exporter starts are not counted as starts
+	m := tracker.update([]string{"a", "b"}, map[string]float64{"a": 9000, "b": 9900}, now)
+	if m.Starts != 0 || m.Stops != 0 {
+		t.Errorf("Unexpected starts %v stops %v for first collection", m.Starts, m.Stops)
+	}
+	if m.Ages.Count != 2 || m.Ages.Sum != 1100 {
+		t.Errorf("Unexpected ages count %v sum %v", m.Ages.Count, m.Ages.Sum)
+	}
+	if val := m.Ages.Buckets[300]; val != 1 {
+		t.Errorf("Unexpected ages in 300 bucket, expected 1, got %v", val)
+	}
+	// c starts without a visible master, b is missing its master so keeps its start time
+	m = tracker.update([]string{"a", "b", "c"}, map[string]float64{"a": 9000}, now)
+	if m.Starts != 1 || m.Stops != 0 {
+		t.Errorf("Unexpected starts %v stops %v after new PUN", m.Starts, m.Stops)
+	}
+	if m.Ages.Count != 2 {
+		t.Errorf("Unexpected ages count %v, PUNs without a start time should not be observed", m.Ages.Count)
+	}
+	// a restarts and c stops
+	m = tracker.update([]string{"a", "b"}, map[string]float64{"a": 9990, "b": 9900}, now)
+	if m.Starts != 2 || m.Stops != 2 {
+		t.Errorf("Unexpected starts %v stops %v after restart and stop", m.Starts, m.Stops)
+	}
+	if m.Ages.Sum != 110 {
+		t.Errorf("Unexpected ages sum %v after restart", m.Ages.Sum)
+	}
+}
+
+func TestPunLifecycleCollect(t *testing.T) {
+	tracker := newPunLifecycleTracker()
+	snapshot := getTestSnapshot(t)
+	mockNow, _ := time.Parse("01/02/2006", "04/17/2020")
+	tracker.update([]string{"msqueo", "tdockendorf"}, getPunMasters(snapshot), mockNow)
+	m := tracker.update([]string{"msqueo"}, getPunMasters(snapshot), mockNow)
+	expected := `
+		# HELP ondemand_pun_age_seconds Age of PUNs since the PUN nginx master process started
+		# TYPE ondemand_pun_age_seconds histogram
+		ondemand_pun_age_seconds_bucket{le="60"} 0
+		ondemand_pun_age_seconds_bucket{le="300"} 0
+		ondemand_pun_age_seconds_bucket{le="900"} 0
+		ondemand_pun_age_seconds_bucket{le="1800"} 0
+		ondemand_pun_age_seconds_bucket{le="3600"} 0
+		ondemand_pun_age_seconds_bucket{le="7200"} 0
+		ondemand_pun_age_seconds_bucket{le="14400"} 0
+		ondemand_pun_age_seconds_bucket{le="28800"} 0
+		ondemand_pun_age_seconds_bucket{le="86400"} 1
+		ondemand_pun_age_seconds_bucket{le="259200"} 1
+		ondemand_pun_age_seconds_bucket{le="604800"} 1
+		ondemand_pun_age_seconds_bucket{le="+Inf"} 1
+		ondemand_pun_age_seconds_sum 37338.390000104904
+		ondemand_pun_age_seconds_count 1
+		# HELP ondemand_pun_starts_total Number of PUNs started since the exporter started
+		# TYPE ondemand_pun_starts_total counter
+		ondemand_pun_starts_total 0
+		# HELP ondemand_pun_stops_total Number of PUNs stopped since the exporter started
+		# TYPE ondemand_pun_stops_total counter
+		ondemand_pun_stops_total 1
+	`
+	if err := testutil.CollectAndCompare(funcCollector(m.collect), strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
@@ -0,0 +1,107 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	nginxStagePath       = kingpin.Flag("path.nginx-stage", "Path to the nginx_stage command").Default("/opt/ood/nginx_stage/sbin/nginx_stage").Envar("NGINX_STAGE_PATH").String()
+	nginxStageConfigFlag = kingpin.Flag("path.nginx-stage-config", "Path to nginx_stage.yml, read from the rootfs").Default("/etc/ood/config/nginx_stage.yml").Envar("NGINX_STAGE_CONFIG").String()
+	nginxStageConfigPath = "/etc/ood/config/nginx_stage.yml"
+	// Defaults of nginx_stage for settings not in nginx_stage.yml
+	defaultNginxStageConfig = NginxStageConfig{
+		PunConfigPath:         "/var/lib/ondemand-nginx/config/puns/%{user}.conf",
+		PunPidPath:            "/var/run/ondemand-nginx/%{user}/passenger.pid",
+		PunSocketPath:         "/var/run/ondemand-nginx/%{user}/passenger.sock",
+		PassengerPoolIdleTime: 300,
+		NginxFileUploadMax:    10737420000,
+	}
+	nginxStageInfo = prometheus.NewDesc(prometheus.BuildFQName(namespace, "nginx_stage", "info"), "Settings of nginx_stage.yml",
+		[]string{"pun_config_path", "pun_pid_path", "pun_socket_path", "passenger_pool_idle_time", "nginx_file_upload_max"}, nil)
+)
+
+// NginxStageConfig are the settings of nginx_stage.yml used by the exporter.
+type NginxStageConfig struct {
+	PunConfigPath         string `yaml:"pun_config_path"`
+	PunPidPath            string `yaml:"pun_pid_path"`
+	PunSocketPath         string `yaml:"pun_socket_path"`
+	PassengerPoolIdleTime int    `yaml:"passenger_pool_idle_time"`
+	NginxFileUploadMax    int64  `yaml:"nginx_file_upload_max"`
+}
+
+// getNginxStageConfig reads nginx_stage.yml, using the nginx_stage defaults for settings not set.
+func getNginxStageConfig(path string, logger *slog.Logger) (NginxStageConfig, error) {
+	config := defaultNginxStageConfig
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		logger.Debug("File not found, using nginx_stage defaults", "file", path)
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return defaultNginxStageConfig, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	logger.Debug("Parsed nginx_stage.yml", "file", path, "config", config)
+	return config, nil
+}
+
+// pidPath returns the PUN pid file path, --collector.puns.pid-path takes precedence.
+func (c NginxStageConfig) pidPath() string {
+	if *punPidPath != "" {
+		return *punPidPath
+	}
+	return c.PunPidPath
+}
+
+// socketPath returns the PUN socket path, --collector.puns.socket-path takes precedence.
+func (c NginxStageConfig) socketPath() string {
+	if *punSocketPath != "" {
+		return *punSocketPath
+	}
+	return c.PunSocketPath
+}
+
+// idleThreshold returns the idle time of Passenger processes, --collector.passenger.idle-threshold takes precedence.
+func (c NginxStageConfig) idleThreshold() time.Duration {
+	if *passengerIdleThreshold > 0 {
+		return *passengerIdleThreshold
+	}
+	return time.Duration(c.PassengerPoolIdleTime) * time.Second
+}
+
+func (c NginxStageConfig) collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(nginxStageInfo, prometheus.GaugeValue, 1, c.PunConfigPath, c.PunPidPath, c.PunSocketPath,
+		strconv.Itoa(c.PassengerPoolIdleTime), strconv.FormatInt(c.NginxFileUploadMax, 10))
+}
@@ -0,0 +1,121 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestGetNginxStageConfig(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	config, err := getNginxStageConfig(filepath.Join(dir, "../fixtures/nginx_stage.yml"), promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expected := defaultNginxStageConfig
+	expected.PunPidPath = "/run/ondemand-nginx/%{user}/passenger.pid"
+	expected.PunSocketPath = "/run/ondemand-nginx/%{user}/passenger.sock"
+	expected.PassengerPoolIdleTime = 600
+	if config != expected {
+		t.Errorf("Unexpected config\nExpected\n%v\nGot\n%v", expected, config)
+	}
+}
+
+func TestGetNginxStageConfigMissing(t *testing.T) {
+	config, err := getNginxStageConfig(filepath.Join(t.TempDir(), "nginx_stage.yml"), promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if config != defaultNginxStageConfig {
+		t.Errorf("Unexpected config %v", config)
+	}
+}
+
+func TestGetNginxStageConfigInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nginx_stage.yml")
+	if err := os.WriteFile(path, []byte("passenger_pool_idle_time: [foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := getNginxStageConfig(path, promslog.NewNopLogger())
+	if err == nil {
+		t.Errorf("Expected error parsing invalid nginx_stage.yml")
+	}
+	if config != defaultNginxStageConfig {
+		t.Errorf("Unexpected config %v", config)
+	}
+}
+
+func TestNginxStageConfigPaths(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	config := defaultNginxStageConfig
+	config.PunPidPath = "/run/ondemand-nginx/%{user}/passenger.pid"
+	if val := config.pidPath(); val != "/run/ondemand-nginx/%{user}/passenger.pid" {
+		t.Errorf("Unexpected pid path %s", val)
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.puns.pid-path=/tmp/%{user}.pid", "--collector.puns.socket-path=/tmp/%{user}.sock"}); err != nil {
+		t.Fatal(err)
+	}
+	// Flags without a default keep their value when parsed again
+	defer func() {
+		*punPidPath = ""
+		*punSocketPath = ""
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	if val := config.pidPath(); val != "/tmp/%{user}.pid" {
+		t.Errorf("Unexpected pid path %s", val)
+	}
+	if val := config.socketPath(); val != "/tmp/%{user}.sock" {
+		t.Errorf("Unexpected socket path %s", val)
+	}
+}
+
+func TestNginxStageConfigIdleThreshold(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	config := defaultNginxStageConfig
+	config.PassengerPoolIdleTime = 600
+	if val := config.idleThreshold(); val != 10*time.Minute {
+		t.Errorf("Unexpected idle threshold %s", val)
+	}
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.passenger.idle-threshold=1m"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		*passengerIdleThreshold = 0
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	if val := config.idleThreshold(); val != time.Minute {
+		t.Errorf("Unexpected idle threshold %s", val)
+	}
+}
@@ -0,0 +1,232 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	oomEnabled = kingpin.Flag("collector.oom", "Enable detecting OOM kills of PUN processes, a heuristic that may count other OOM kills of the host").Default("false").Envar("OOM_ENABLED").Bool()
+	oomTracker = newOOMKillTracker()
+)
+
+type OOMCollector struct {
+	OOMKills    *prometheus.Desc
+	LastOOMKill *prometheus.Desc
+	logger      *slog.Logger
+}
+
+// oomObservation is the state of OOM kills and PUN processes of a collection.
+type oomObservation struct {
+	vmstat     float64
+	vmstatOK   bool
+	cgroups    map[string]float64
+	uidCgroups map[string][]string
+	procs      map[punProcess]struct{}
+	partial    bool
+}
+
+// oomKillTracker counts OOM kills of PUN processes.
+type oomKillTracker struct {
+	sync.Mutex
+	initialized bool
+	vmstat      float64
+	vmstatOK    bool
+	cgroups     map[string]float64
+	uidCgroups  map[string][]string
+	procs       map[punProcess]struct{}
+	kills       float64
+	last        float64
+}
+
+func newOOMKillTracker() *oomKillTracker {
+	return &oomKillTracker{
+		cgroups:    make(map[string]float64),
+		uidCgroups: make(map[string][]string),
+		procs:      make(map[punProcess]struct{}),
+	}
+}
+
+// knownCgroups returns the cgroups last seen for PUN UIDs.
+func (t *oomKillTracker) knownCgroups(puns []string) map[string][]string {
+	t.Lock()
+	defer t.Unlock()
+	cgroups := make(map[string][]string)
+	for uid, paths := range t.uidCgroups {
+		if slices.Contains(puns, uid) {
+			cgroups[uid] = slices.Clone(paths)
+		}
+	}
+	return cgroups
+}
+
+// update counts OOM kills since the previous observation and returns the total and last kill time.
+func (t *oomKillTracker) update(obs oomObservation, now time.Time) (float64, float64) {
+	t.Lock()
+	defer t.Unlock()
+	if t.initialized {
+		var kills float64
+		for path, value := range obs.cgroups {
+			if prev, ok := t.cgroups[path]; ok && value > prev {
+				kills += value - prev
+			}
+		}
+		if !obs.partial && obs.vmstatOK && t.vmstatOK && obs.vmstat > t.vmstat {
+			var vanished float64
+			for p := range t.procs {
+				if _, ok := obs.procs[p]; ok {
+					continue
+				}
+				if _, ok := obs.uidCgroups[p.uid]; ok {
+					continue
+				}
+				vanished++
+			}
+			kills += min(obs.vmstat-t.vmstat, vanished)
+		}
+		if kills > 0 {
+			t.kills += kills
+			t.last = float64(now.Unix())
+		}
+	}
+	t.initialized = true
+	t.cgroups = obs.cgroups
+	t.uidCgroups = obs.uidCgroups
+	if !obs.partial {
+		t.vmstat = obs.vmstat
+		t.vmstatOK = obs.vmstatOK
+		t.procs = obs.procs
+	}
+	return t.kills, t.last
+}
+
+// getVMStatOOMKill returns the number of OOM kills on the host from /proc/vmstat.
+func getVMStatOOMKill() (float64, error) {
+	data, err := os.ReadFile(filepath.Join(procFS, "vmstat"))
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseFloat(fields[1], 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("oom_kill not found in vmstat")
+}
+
+// getOOMObservation reads OOM kill counters and the PUN processes of the snapshot.
+func getOOMObservation(snapshot *ProcessSnapshot, puns []string, logger *slog.Logger) (oomObservation, error) {
+	obs := oomObservation{
+		cgroups:    make(map[string]float64),
+		uidCgroups: make(map[string][]string),
+		procs:      make(map[punProcess]struct{}),
+	}
+	if snapshot == nil {
+		return obs, errors.New("no procfs snapshot")
+	}
+	obs.partial = snapshot.Partial
+	for _, proc := range snapshot.Procs {
+		if slices.Contains(puns, proc.UID) {
+			obs.procs[punProcess{pid: proc.PID, uid: proc.UID, starttime: proc.Stat.Starttime}] = struct{}{}
+		}
+	}
+	if value, err := getVMStatOOMKill(); err == nil {
+		obs.vmstat = value
+		obs.vmstatOK = true
+	} else {
+		logger.Debug("Unable to read oom_kill from vmstat", "err", err)
+	}
+	if _, err := os.Stat(filepath.Join(cgroupFS, "cgroup.controllers")); err != nil {
+		logger.Debug("cgroup v2 not available", "path", cgroupFS, "err", err)
+	} else {
+		uidCgroups := oomTracker.knownCgroups(puns)
+		for uid, paths := range getPunCgroups(snapshot, puns, logger) {
+			for _, path := range paths {
+				if !slices.Contains(uidCgroups[uid], path) {
+					uidCgroups[uid] = append(uidCgroups[uid], path)
+				}
+			}
+		}
+		for uid, paths := range uidCgroups {
+			for _, path := range paths {
+				if _, ok := obs.cgroups[path]; ok {
+					obs.uidCgroups[uid] = append(obs.uidCgroups[uid], path)
+					continue
+				}
+				values, err := readCgroupKeyValues(filepath.Join(cgroupFS, path, "memory.events"))
+				if err != nil {
+					// The cgroup may have been removed once it had no processes
+					logger.Debug("Unable to read cgroup memory.events", "cgroup", path, "uid", uid, "err", err)
+					continue
+				}
+				obs.cgroups[path] = values["oom_kill"]
+				obs.uidCgroups[uid] = append(obs.uidCgroups[uid], path)
+			}
+		}
+	}
+	if !obs.vmstatOK && len(obs.cgroups) == 0 {
+		return obs, errors.New("unable to read OOM kills from vmstat or cgroups")
+	}
+	return obs, nil
+}
+
+func NewOOMCollector(logger *slog.Logger) *OOMCollector {
+	return &OOMCollector{
+		logger:      logger,
+		OOMKills:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "oom_kills_total"), "Number of PUN processes killed by the OOM killer since the exporter started", nil, nil),
+		LastOOMKill: prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "last_oom_kill_timestamp_seconds"), "Time an OOM kill of a PUN process was last detected", nil, nil),
+	}
+}
+
+func (c *OOMCollector) collect(snapshot *ProcessSnapshot, puns []string, ch chan<- prometheus.Metric) error {
+	c.logger.Debug("Collecting OOM kill metrics")
+	collectTime := time.Now()
+	obs, err := getOOMObservation(snapshot, puns, c.logger)
+	if err != nil {
+		return err
+	}
+	kills, last := oomTracker.update(obs, timeNow())
+	ch <- prometheus.MustNewConstMetric(c.OOMKills, prometheus.CounterValue, kills)
+	ch <- prometheus.MustNewConstMetric(c.LastOOMKill, prometheus.GaugeValue, last)
+	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "oom")
+	return nil
+}
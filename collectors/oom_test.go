@@ -0,0 +1,194 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func TestOOMKillTracker(t *testing.T) {
+	tracker := newOOMKillTracker()
+	now := time.Unix(1587100000, 0)
+	procs := map[punProcess]struct{}{
+		{pid: 1000, uid: "20821", starttime: 100}: {},
+		{pid: 1001, uid: "20821", starttime: 110}: {},
+		{pid: 2000, uid: "30001", starttime: 200}: {},
+		{pid: 2001, uid: "30001", starttime: 210}: {},
+	}
+	obs := oomObservation{
+		vmstat:     10,
+		vmstatOK:   true,
+		cgroups:    map[string]float64{"/user.slice/user-20821.slice": 5},
+		uidCgroups: map[string][]string{"20821": {"/user.slice/user-20821.slice"}},
+		procs:      procs,
+	}
+	// The first observation is only a baseline
+	if kills, last := tracker.update(obs, now); kills != 0 || last != 0 {
+		t.Errorf("Unexpected OOM kills on first update, got %v at %v", kills, last)
+	}
+	// Kill in the cgroup of 20821 and one process of 20821 and one of 30001 disappears
+	obs = oomObservation{
+		vmstat:     12,
+		vmstatOK:   true,
+		cgroups:    map[string]float64{"/user.slice/user-20821.slice": 6},
+		uidCgroups: map[string][]string{"20821": {"/user.slice/user-20821.slice"}},
+		procs: map[punProcess]struct{}{
+			{pid: 1000, uid: "20821", starttime: 100}: {},
+			{pid: 2000, uid: "30001", starttime: 200}: {},
+		},
+	}
+	if kills, last := tracker.update(obs, now.Add(time.Minute)); kills != 2 || last != 1587100060 {
+		t.Errorf("Unexpected OOM kills, expected 2 at 1587100060, got %v at %v", kills, last)
+	}
+	// Host OOM kills are only counted up to the number of disappeared PUN processes
+	obs.vmstat = 20
+	obs.procs = map[punProcess]struct{}{
+		{pid: 1000, uid: "20821", starttime: 100}: {},
+	}
+	if kills, last := tracker.update(obs, now.Add(2*time.Minute)); kills != 3 || last != 1587100120 {
+		t.Errorf("Unexpected OOM kills, expected 3 at 1587100120, got %v at %v", kills, last)
+	}
+	// PID reused by a new process counts as the process disappearing
+	obs.vmstat = 21
+	obs.procs = map[punProcess]struct{}{
+		{pid: 1000, uid: "30001", starttime: 300}: {},
+	}
+	obs.uidCgroups = map[string][]string{}
+	if kills, _ := tracker.update(obs, now.Add(3*time.Minute)); kills != 4 {
+		t.Errorf("Unexpected OOM kills, expected 4, got %v", kills)
+	}
+	// Partial snapshots do not count disappeared processes
+	obs.vmstat = 25
+	obs.procs = map[punProcess]struct{}{}
+	obs.partial = true
+	if kills, last := tracker.update(obs, now.Add(4*time.Minute)); kills != 4 || last != 1587100180 {
+		t.Errorf("Unexpected OOM kills for partial observation, expected 4 at 1587100180, got %v at %v", kills, last)
+	}
+	if val := tracker.vmstat; val != 21 {
+		t.Errorf("Unexpected vmstat after partial observation, expected 21, got %v", val)
+	}
+	// Counters that reset, such as a recreated cgroup, are not counted
+	obs = oomObservation{
+		vmstat:     21,
+		vmstatOK:   true,
+		cgroups:    map[string]float64{"/user.slice/user-20821.slice": 0},
+		uidCgroups: map[string][]string{"20821": {"/user.slice/user-20821.slice"}},
+		procs:      map[punProcess]struct{}{{pid: 1000, uid: "30001", starttime: 300}: {}},
+	}
+	if kills, _ := tracker.update(obs, now.Add(5*time.Minute)); kills != 4 {
+		t.Errorf("Unexpected OOM kills after counter reset, expected 4, got %v", kills)
+	}
+}
+
+func TestGetVMStatOOMKill(t *testing.T) {
+	getTestSnapshot(t)
+	value, err := getVMStatOOMKill()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if value != 3 {
+		t.Errorf("Unexpected oom_kill, expected 3, got %v", value)
+	}
+}
+
+func TestGetOOMObservation(t *testing.T) {
+	setupCgroupFS()
+	snapshot := getTestSnapshot(t)
+	defer func() { oomTracker = newOOMKillTracker() }()
+	oomTracker = newOOMKillTracker()
+	// 55555 had processes in a cgroup that was removed and in one that still exists
+	oomTracker.uidCgroups = map[string][]string{
+		"55555": {"/user.slice/user-55555.slice", "/user.slice/user-20821.slice"},
+		"99999": {"/user.slice/user-99999.slice"},
+	}
+	obs, err := getOOMObservation(snapshot, []string{"32666", "20821", "30001", "55555"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !obs.vmstatOK || obs.vmstat != 3 {
+		t.Errorf("Unexpected vmstat, expected 3, got %v", obs.vmstat)
+	}
+	expectedCgroups := map[string]float64{
+		"/user.slice/user-32666.slice/ondemand-nginx.scope": 1,
+		"/user.slice/user-20821.slice":                      0,
+	}
+	if !reflect.DeepEqual(obs.cgroups, expectedCgroups) {
+		t.Errorf("Unexpected cgroups\nExpected\n%v\nGot\n%v", expectedCgroups, obs.cgroups)
+	}
+	expectedUIDCgroups := map[string][]string{
+		"32666": {"/user.slice/user-32666.slice/ondemand-nginx.scope"},
+		"20821": {"/user.slice/user-20821.slice"},
+		"55555": {"/user.slice/user-20821.slice"},
+	}
+	if !reflect.DeepEqual(obs.uidCgroups, expectedUIDCgroups) {
+		t.Errorf("Unexpected UID cgroups\nExpected\n%v\nGot\n%v", expectedUIDCgroups, obs.uidCgroups)
+	}
+	if val := len(obs.procs); val != 16 {
+		t.Errorf("Unexpected number of PUN processes, expected 16, got %d", val)
+	}
+}
+
+func TestOOMCollector(t *testing.T) {
+	setupCgroupFS()
+	snapshot := getTestSnapshot(t)
+	defer func() {
+		oomTracker = newOOMKillTracker()
+		timeNow = getTimeNow
+	}()
+	timeNow = func() time.Time {
+		return time.Unix(1587100000, 0)
+	}
+	// Previous collection before an OOM kill in the cgroup of 32666 and
+	// a process of 30001, which has no cgroup v2, disappeared
+	oomTracker = newOOMKillTracker()
+	oomTracker.initialized = true
+	oomTracker.vmstat = 1
+	oomTracker.vmstatOK = true
+	oomTracker.cgroups = map[string]float64{"/user.slice/user-32666.slice/ondemand-nginx.scope": 0}
+	oomTracker.uidCgroups = map[string][]string{"32666": {"/user.slice/user-32666.slice/ondemand-nginx.scope"}}
+	oomTracker.procs = map[punProcess]struct{}{
+		{pid: 71817, uid: "32666", starttime: 100}: {},
+		{pid: 86150, uid: "30001", starttime: 100}: {},
+	}
+	expected := `
+		# HELP ondemand_pun_last_oom_kill_timestamp_seconds Time an OOM kill of a PUN process was last detected
+		# TYPE ondemand_pun_last_oom_kill_timestamp_seconds gauge
+		ondemand_pun_last_oom_kill_timestamp_seconds 1587100000
+		# HELP ondemand_pun_oom_kills_total Number of PUN processes killed by the OOM killer since the exporter started
+		# TYPE ondemand_pun_oom_kills_total counter
+		ondemand_pun_oom_kills_total 2
+	`
+	collector := NewOOMCollector(promslog.NewNopLogger())
+	c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666", "30001"}, ch) })
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_pun_last_oom_kill_timestamp_seconds",
+		"ondemand_pun_oom_kills_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"log/slog"
 	"slices"
@@ -36,36 +37,89 @@ import (
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/procfs"
 	"golang.org/x/net/html/charset"
 )
 
 const (
 	microsecondsPerSecond = 1000000
+	// Allowed difference between a process start time and when Passenger spawned it
+	passengerSpawnTolerance = 5
+)
+
+const (
+	passengerErrorTimeout = "timeout"
+	passengerErrorParse   = "parse"
+	passengerErrorQuery   = "query"
 )
 
 var (
 	passengerTimeout            = kingpin.Flag("collector.passenger.timeout", "Timeout for collecting Passenger metrics").Default("30").Envar("PASSENGER_TIMEOUT").Int()
-	passengerStatusPath         = kingpin.Flag("path.passenger-status", "Path to OnDemand passenger-status").Default("/usr/sbin/ondemand-passenger-status").Envar("PASSENGER_STATUS").String()
+	passengerStatusPath         = kingpin.Flag("path.passenger-status", "Path to OnDemand passenger-status, executed in the filesystem of the exporter").Default("/usr/sbin/ondemand-passenger-status").Envar("PASSENGER_STATUS").String()
+	passengerConcurrency        = kingpin.Flag("collector.passenger.concurrency", "Number of Passenger instances to collect concurrently").Default("10").Envar("PASSENGER_CONCURRENCY").Int()
+	passengerIdleThreshold      = kingpin.Flag("collector.passenger.idle-threshold", "Duration since last use after which a Passenger process is considered idle, defaults to passenger_pool_idle_time of nginx_stage.yml").Envar("PASSENGER_IDLE_THRESHOLD").Duration()
+	passengerSpawnBuckets       = []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 90}
+	passengerPerUser            = kingpin.Flag("collector.passenger.per-user", "Collect Passenger metrics per PUN user").Default("false").Envar("PASSENGER_PER_USER").Bool()
 	passengerStatusExec         = passengerStatus
 	passengerStatusExecInstance = passengerStatus
 	passengerMetricMutex        = sync.RWMutex{}
+	passengerErrorReasons       = []string{passengerErrorTimeout, passengerErrorParse, passengerErrorQuery}
+	errPassengerParse           = errors.New("unable to parse Passenger status")
 )
 
 type PassengerCollector struct {
-	Instances  *prometheus.Desc
-	Count      *prometheus.Desc
-	ProcCount  *prometheus.Desc
-	RSS        *prometheus.Desc
-	CPU        *prometheus.Desc
-	RealMemory *prometheus.Desc
-	Requests   *prometheus.Desc
-	AvgRuntime *prometheus.Desc
-	logger     *slog.Logger
+	Info            *prometheus.Desc
+	Instances       *prometheus.Desc
+	InstanceUptime  *prometheus.Desc
+	InstanceErrors  *prometheus.Desc
+	InstancesByUser *prometheus.Desc
+	AppInfo         *prometheus.Desc
+	Count           *prometheus.Desc
+	ProcCount       *prometheus.Desc
+	RSS             *prometheus.Desc
+	CPU             *prometheus.Desc
+	RealMemory      *prometheus.Desc
+	Requests        *prometheus.Desc
+	Spawned         *prometheus.Desc
+	Exited          *prometheus.Desc
+	CPUSeconds      *prometheus.Desc
+	ReadBytes       *prometheus.Desc
+	WriteBytes      *prometheus.Desc
+	CtxtSwitches    *prometheus.Desc
+	AvgRuntime      *prometheus.Desc
+	SpawnDuration   *prometheus.Desc
+	LastUsed        *prometheus.Desc
+	IdleProcesses   *prometheus.Desc
+	UserProcCount   *prometheus.Desc
+	UserRSS         *prometheus.Desc
+	UserRealMemory  *prometheus.Desc
+	UserRequests    *prometheus.Desc
+	snapshot        *ProcessSnapshot
+	requests        map[string]int
+	logger          *slog.Logger
+}
+
+// PassengerInstance is a Passenger instance identified by its watchdog PID
+// and the PUN user that owns it. Dir is set when the instance was found
+// in the instance registry. CoreStartTime is the start time of the Passenger
+// core when the core could be read from procfs.
+type PassengerInstance struct {
+	Name          string
+	PID           string
+	UID           string
+	User          string
+	Dir           string
+	Version       string
+	CoreStartTime float64
 }
 
 type PassengerAppMetrics struct {
 	Name              string
+	AppType           string
+	Environment       string
+	SpawnMethod       string
+	Instance          string
+	UID               string
+	User              string
 	Count             int
 	ProcCount         int
 	Processes         []PassengerProcessMetrics
@@ -74,34 +128,62 @@ type PassengerAppMetrics struct {
 	RealMemory        int
 	RequestsProcessed int
 	Runtime           int64
+	Idle              int64
+	IdleProcesses     int
 }
 type PassengerProcessMetrics struct {
+	ID                string
 	RSS               int
 	CPU               float64
 	RealMemory        int
 	RequestsProcessed int
 	Runtime           int64
+	SpawnDuration     float64
+	Idle              int64
+	// Values read from procfs, ProcStats is false when the process could not be read
+	ProcStats                bool
+	CPUSeconds               float64
+	ReadBytes                uint64
+	WriteBytes               uint64
+	VoluntaryCtxtSwitches    uint64
+	NonVoluntaryCtxtSwitches uint64
 }
 
 func NewPassengerCollector(logger *slog.Logger) *PassengerCollector {
 	return &PassengerCollector{
-		logger:     logger,
-		Instances:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger", "instances"), "Number of Passenger instances", nil, nil),
-		Count:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "count"), "Count of passenger instances of an app", []string{"app"}, nil),
-		ProcCount:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "processes"), "Process count of an app", []string{"app"}, nil),
-		RSS:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "rss_bytes"), "RSS of passenger apps", []string{"app"}, nil),
-		RealMemory: prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "real_memory_bytes"), "Real memory of passenger apps", []string{"app"}, nil),
-		CPU:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "cpu_percent"), "CPU percent of passenger apps", []string{"app"}, nil),
-		Requests:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "requests_total"), "Requests made to passenger apps", []string{"app"}, nil),
-		AvgRuntime: prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "average_runtime_seconds"), "Average runtime in seconds of passenger apps", []string{"app"}, nil),
+		logger:          logger,
+		Info:            prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger", "info"), "Number of Passenger instances running a Passenger version", []string{"version"}, nil),
+		Instances:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger", "instances"), "Number of Passenger instances", nil, nil),
+		InstanceUptime:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger", "instance_uptime_seconds"), "Seconds since the Passenger core of an instance started", []string{"instance"}, nil),
+		InstanceErrors:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger", "instance_errors"), "Number of Passenger instances that could not be collected", []string{"reason"}, nil),
+		InstancesByUser: prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger", "instances_by_user"), "Number of Passenger instances owned by a user", []string{"user"}, nil),
+		AppInfo:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "info"), "Information about passenger apps", []string{"app", "app_type", "environment", "spawn_method"}, nil),
+		Count:           prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "count"), "Count of passenger instances of an app", []string{"app", "app_type"}, nil),
+		ProcCount:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "processes"), "Process count of an app", []string{"app", "app_type"}, nil),
+		RSS:             prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "rss_bytes"), "RSS of passenger apps", []string{"app", "app_type"}, nil),
+		RealMemory:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "real_memory_bytes"), "Real memory of passenger apps", []string{"app", "app_type"}, nil),
+		CPU:             prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "cpu_percent"), "CPU percent of passenger apps", []string{"app", "app_type"}, nil),
+		Requests:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "requests_total"), "Requests made to passenger apps", []string{"app", "app_type"}, nil),
+		Spawned:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "processes_spawned_total"), "Passenger processes spawned for an app", []string{"app", "app_type"}, nil),
+		Exited:          prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "processes_exited_total"), "Passenger processes of an app that exited", []string{"app", "app_type"}, nil),
+		CPUSeconds:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "cpu_seconds_total"), "CPU time in seconds of passenger app processes", []string{"app", "app_type"}, nil),
+		ReadBytes:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "read_bytes_total"), "Bytes read from storage by passenger app processes", []string{"app", "app_type"}, nil),
+		WriteBytes:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "write_bytes_total"), "Bytes written to storage by passenger app processes", []string{"app", "app_type"}, nil),
+		CtxtSwitches:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "context_switches_total"), "Context switches of passenger app processes", []string{"app", "app_type", "type"}, nil),
+		AvgRuntime:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "average_runtime_seconds"), "Average runtime in seconds of passenger apps", []string{"app", "app_type"}, nil),
+		SpawnDuration:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "spawn_duration_seconds"), "Time taken to spawn passenger app processes", []string{"app", "app_type"}, nil),
+		LastUsed:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "seconds_since_last_used"), "Seconds since a passenger app process was last used", []string{"app", "app_type"}, nil),
+		IdleProcesses:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_app", "idle_processes"), "Passenger app processes not used within the idle threshold", []string{"app", "app_type"}, nil),
+		UserProcCount:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_user_app", "processes"), "Process count of an app for a user", []string{"app", "user"}, nil),
+		UserRSS:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_user_app", "rss_bytes"), "RSS of passenger apps for a user", []string{"app", "user"}, nil),
+		UserRealMemory:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_user_app", "real_memory_bytes"), "Real memory of passenger apps for a user", []string{"app", "user"}, nil),
+		UserRequests:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "passenger_user_app", "requests_total"), "Requests made to passenger apps for a user", []string{"app", "user"}, nil),
 	}
 }
 
-func (c *PassengerCollector) collect(puns []string, ch chan<- prometheus.Metric) error {
+func (c *PassengerCollector) collect(snapshot *ProcessSnapshot, puns []string, nginxStage NginxStageConfig, ch chan<- prometheus.Metric) error {
 	c.logger.Debug("Collecting passenger metrics")
-	if !fileExists(*passengerStatusPath) {
-		return fmt.Errorf("%s not found", *passengerStatusPath)
-	}
+	c.snapshot = snapshot
 	collectTime := time.Now()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*passengerTimeout)*time.Second)
 	defer cancel()
@@ -109,14 +191,31 @@ func (c *PassengerCollector) collect(puns []string, ch chan<- prometheus.Metric)
 	if err != nil {
 		return err
 	}
-	metrics, errors := c.getInstancesMetrics(ctx, instances)
-	if errors != nil {
+	metrics, errs := c.getInstancesMetrics(ctx, instances)
+	instanceErrors := make(map[string]int)
+	for _, e := range errs {
+		instanceErrors[passengerErrorReason(e)]++
+	}
+	for _, reason := range passengerErrorReasons {
+		ch <- prometheus.MustNewConstMetric(c.InstanceErrors, prometheus.GaugeValue, float64(instanceErrors[reason]), reason)
+	}
+	if len(errs) > 0 && len(errs) == len(instances) {
 		err := ""
-		for _, e := range errors {
+		for _, e := range errs {
 			err = err + " " + e.Error()
 		}
 		return fmt.Errorf("%s", err)
 	}
+	var failed []string
+	for _, e := range errs {
+		var instanceErr *passengerInstanceError
+		if errors.As(e, &instanceErr) {
+			failed = append(failed, instanceErr.instance)
+		}
+	}
+	idleThreshold := nginxStage.idleThreshold()
+	counters := passengerTracker.update(instances, failed, metrics, timeNow(), *passengerAppRetention)
+	c.requests = passengerUserRequests(instances, failed, metrics)
 	appMetrics := make(map[string]PassengerAppMetrics)
 	for _, m := range metrics {
 		var metric PassengerAppMetrics
@@ -137,35 +236,156 @@ func (c *PassengerCollector) collect(puns []string, ch chan<- prometheus.Metric)
 			metric.CPU = metric.CPU + p.CPU
 			metric.RequestsProcessed = metric.RequestsProcessed + p.RequestsProcessed
 			metric.Runtime = metric.Runtime + p.Runtime
+			if metric.ProcCount == 1 || p.Idle < metric.Idle {
+				metric.Idle = p.Idle
+			}
+			if float64(p.Idle) >= idleThreshold.Seconds() {
+				metric.IdleProcesses++
+			}
 		}
 		appMetrics[m.Name] = metric
 	}
 	for name, metric := range appMetrics {
-		ch <- prometheus.MustNewConstMetric(c.Count, prometheus.GaugeValue, float64(metric.Count), name)
-		ch <- prometheus.MustNewConstMetric(c.ProcCount, prometheus.GaugeValue, float64(metric.ProcCount), name)
-		ch <- prometheus.MustNewConstMetric(c.RSS, prometheus.GaugeValue, float64(metric.RSS), name)
-		ch <- prometheus.MustNewConstMetric(c.RealMemory, prometheus.GaugeValue, float64(metric.RealMemory), name)
-		ch <- prometheus.MustNewConstMetric(c.CPU, prometheus.GaugeValue, metric.CPU, name)
-		ch <- prometheus.MustNewConstMetric(c.Requests, prometheus.CounterValue, float64(metric.RequestsProcessed), name)
+		app := appLabel(name, metric.User)
+		ch <- prometheus.MustNewConstMetric(c.AppInfo, prometheus.GaugeValue, 1, app, metric.AppType, metric.Environment, metric.SpawnMethod)
+		ch <- prometheus.MustNewConstMetric(c.Count, prometheus.GaugeValue, float64(metric.Count), app, metric.AppType)
+		ch <- prometheus.MustNewConstMetric(c.ProcCount, prometheus.GaugeValue, float64(metric.ProcCount), app, metric.AppType)
+		ch <- prometheus.MustNewConstMetric(c.RSS, prometheus.GaugeValue, float64(metric.RSS), app, metric.AppType)
+		ch <- prometheus.MustNewConstMetric(c.RealMemory, prometheus.GaugeValue, float64(metric.RealMemory), app, metric.AppType)
+		ch <- prometheus.MustNewConstMetric(c.CPU, prometheus.GaugeValue, metric.CPU, app, metric.AppType)
+		ch <- prometheus.MustNewConstMetric(c.Requests, prometheus.CounterValue, float64(counters[name].Requests), app, metric.AppType)
+		ch <- prometheus.MustNewConstMetric(c.Spawned, prometheus.CounterValue, float64(counters[name].Spawned), app, metric.AppType)
+		ch <- prometheus.MustNewConstMetric(c.Exited, prometheus.CounterValue, float64(counters[name].Exited), app, metric.AppType)
+		if counters[name].ProcStats {
+			ch <- prometheus.MustNewConstMetric(c.CPUSeconds, prometheus.CounterValue, counters[name].CPUSeconds, app, metric.AppType)
+			ch <- prometheus.MustNewConstMetric(c.ReadBytes, prometheus.CounterValue, float64(counters[name].ReadBytes), app, metric.AppType)
+			ch <- prometheus.MustNewConstMetric(c.WriteBytes, prometheus.CounterValue, float64(counters[name].WriteBytes), app, metric.AppType)
+			ch <- prometheus.MustNewConstMetric(c.CtxtSwitches, prometheus.CounterValue, float64(counters[name].VoluntaryCtxtSwitches), app, metric.AppType, "voluntary")
+			ch <- prometheus.MustNewConstMetric(c.CtxtSwitches, prometheus.CounterValue, float64(counters[name].NonVoluntaryCtxtSwitches), app, metric.AppType, "nonvoluntary")
+		}
 		var runtime float64
 		if metric.ProcCount > 0 {
 			runtime = float64(metric.Runtime / int64(metric.ProcCount))
 		} else {
 			runtime = 0
 		}
-		ch <- prometheus.MustNewConstMetric(c.AvgRuntime, prometheus.GaugeValue, runtime, name)
+		ch <- prometheus.MustNewConstMetric(c.AvgRuntime, prometheus.GaugeValue, runtime, app, metric.AppType)
+		spawn := counters[name].SpawnDurations
+		ch <- prometheus.MustNewConstHistogram(c.SpawnDuration, spawn.Count, spawn.Sum, spawn.Buckets, app, metric.AppType)
+		if metric.ProcCount > 0 {
+			ch <- prometheus.MustNewConstMetric(c.LastUsed, prometheus.GaugeValue, float64(metric.Idle), app, metric.AppType)
+		}
+		ch <- prometheus.MustNewConstMetric(c.IdleProcesses, prometheus.GaugeValue, float64(metric.IdleProcesses), app, metric.AppType)
 	}
+	if *passengerPerUser {
+		c.collectPerUser(instances, metrics, counters, ch)
+	}
+	c.collectInstances(instances, ch)
 	ch <- prometheus.MustNewConstMetric(c.Instances, prometheus.GaugeValue, float64(len(instances)))
 	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "passenger")
 	return nil
 }
 
-func (c *PassengerCollector) getInstances(puns []string, ctx context.Context) ([]string, error) {
+// passengerUserRequests returns the requests processed by the Passenger processes of each PUN UID.
+// PUNs with an instance that could not be collected are left out as their requests are unknown,
+// PUNs without a Passenger instance are not included.
+func passengerUserRequests(instances []PassengerInstance, failed []string, metrics []PassengerAppMetrics) map[string]int {
+	requests := make(map[string]int)
+	for _, instance := range instances {
+		if instance.UID != "" {
+			requests[instance.UID] = 0
+		}
+	}
+	for _, m := range metrics {
+		if m.UID == "" {
+			continue
+		}
+		for _, p := range m.Processes {
+			requests[m.UID] += p.RequestsProcessed
+		}
+	}
+	for _, instance := range instances {
+		if instance.UID != "" && slices.Contains(failed, instance.PID) {
+			delete(requests, instance.UID)
+		}
+	}
+	return requests
+}
+
+func (c *PassengerCollector) collectInstances(instances []PassengerInstance, ch chan<- prometheus.Metric) {
+	now := float64(timeNow().Unix())
+	versions := make(map[string]int)
+	for _, instance := range instances {
+		if instance.Version != "" {
+			versions[instance.Version]++
+		}
+		if instance.CoreStartTime > 0 {
+			name := instance.Name
+			if name == "" {
+				name = instance.PID
+			}
+			ch <- prometheus.MustNewConstMetric(c.InstanceUptime, prometheus.GaugeValue, now-instance.CoreStartTime, name)
+		}
+	}
+	for version, count := range versions {
+		ch <- prometheus.MustNewConstMetric(c.Info, prometheus.GaugeValue, float64(count), version)
+	}
+}
+
+func (c *PassengerCollector) collectPerUser(instances []PassengerInstance, metrics []PassengerAppMetrics, counters map[string]PassengerAppCounters, ch chan<- prometheus.Metric) {
+	instancesByUser := make(map[string]int)
+	for _, instance := range instances {
+		if instance.User == "" {
+			c.logger.Debug("Unable to determine owner of Passenger instance", "instance", instance.PID)
+			continue
+		}
+		instancesByUser[userLabel(instance.User)]++
+	}
+	for user, count := range instancesByUser {
+		ch <- prometheus.MustNewConstMetric(c.InstancesByUser, prometheus.GaugeValue, float64(count), user)
+	}
+	type userApp struct {
+		app  string
+		user string
+	}
+	userMetrics := make(map[userApp]PassengerAppMetrics)
+	for _, m := range metrics {
+		if m.User == "" {
+			continue
+		}
+		key := userApp{app: appLabel(m.Name, m.User), user: userLabel(m.User)}
+		metric := userMetrics[key]
+		metric.RequestsProcessed = counters[m.Name].UserRequests[m.User]
+		for _, p := range m.Processes {
+			metric.ProcCount++
+			metric.RSS = metric.RSS + p.RSS
+			metric.RealMemory = metric.RealMemory + p.RealMemory
+		}
+		userMetrics[key] = metric
+	}
+	for key, metric := range userMetrics {
+		ch <- prometheus.MustNewConstMetric(c.UserProcCount, prometheus.GaugeValue, float64(metric.ProcCount), key.app, key.user)
+		ch <- prometheus.MustNewConstMetric(c.UserRSS, prometheus.GaugeValue, float64(metric.RSS), key.app, key.user)
+		ch <- prometheus.MustNewConstMetric(c.UserRealMemory, prometheus.GaugeValue, float64(metric.RealMemory), key.app, key.user)
+		ch <- prometheus.MustNewConstMetric(c.UserRequests, prometheus.CounterValue, float64(metric.RequestsProcessed), key.app, key.user)
+	}
+}
+
+func (c *PassengerCollector) getInstances(puns []string, ctx context.Context) ([]PassengerInstance, error) {
+	if *passengerNative {
+		instances, err := c.getRegistryInstances(puns)
+		if err != nil {
+			c.logger.Debug("Unable to read Passenger instance registry", "path", passengerRegistryPath, "err", err)
+		} else if len(instances) > 0 {
+			return instances, nil
+		}
+		c.logger.Debug("No instances found in Passenger instance registry, using passenger-status", "path", passengerRegistryPath)
+	}
 	out, err := passengerStatusExec(ctx, "", c.logger)
 	if err != nil {
 		return nil, err
 	}
-	var instances []string
+	var instances []PassengerInstance
 	// Single instance running, collect PID
 	if strings.HasPrefix(out, "<?xml") {
 		instances, err = c.getInstancesByPID(puns)
@@ -186,30 +406,48 @@ func (c *PassengerCollector) getInstances(puns []string, ctx context.Context) ([
 		if len(items) != 4 {
 			continue
 		}
-		instances = append(instances, items[1])
+		instance := PassengerInstance{Name: items[0], PID: items[1]}
+		if version, ok := strings.CutPrefix(items[3], "Phusion_Passenger/"); ok {
+			instance.Version = version
+		}
+		instance.UID = c.getInstanceOwner(instance.PID, puns)
+		if instance.UID != "" {
+			instance.User = getUsername(instance.UID, c.logger)
+			instance.CoreStartTime = c.getCoreStartTime(instance)
+		}
+		instances = append(instances, instance)
 	}
 	return instances, nil
 }
 
-func (c *PassengerCollector) getInstancesByPID(puns []string) ([]string, error) {
-	var pids []string
-	procfs, err := procfs.NewFS(procFS)
+// getInstanceOwner returns the UID owning the watchdog PID of an instance,
+// or an empty string if the owner is not a PUN user or can not be read.
+func (c *PassengerCollector) getInstanceOwner(pid string, puns []string) string {
+	p, err := strconv.Atoi(pid)
 	if err != nil {
-		return nil, err
+		c.logger.Debug("Invalid Passenger instance PID", "pid", pid)
+		return ""
 	}
-	procs, err := procfs.AllProcs()
-	if err != nil {
-		return nil, err
+	proc, ok := c.snapshot.Get(p)
+	if !ok {
+		c.logger.Debug("Unable to find Passenger instance process", "pid", pid)
+		return ""
 	}
-	for _, proc := range procs {
-		procCmdLine, _ := proc.CmdLine()
-		cmdline := strings.Join(procCmdLine, " ")
-		status, err := proc.NewStatus()
-		if err != nil {
-			c.logger.Debug("Unable to get process status", "pid", proc.PID, "cmdline", cmdline)
-			continue
-		}
-		uid := strconv.FormatUint(status.UIDs[0], 10)
+	if !slices.Contains(puns, proc.UID) {
+		c.logger.Debug("Passenger instance does not belong to PUN", "pid", pid, "uid", proc.UID)
+		return ""
+	}
+	return proc.UID
+}
+
+func (c *PassengerCollector) getInstancesByPID(puns []string) ([]PassengerInstance, error) {
+	var instances []PassengerInstance
+	if c.snapshot == nil {
+		return nil, errors.New("no procfs snapshot")
+	}
+	for _, proc := range c.snapshot.Procs {
+		cmdline := strings.Join(proc.Cmdline, " ")
+		uid := proc.UID
 		if uid == "0" {
 			continue
 		}
@@ -222,43 +460,102 @@ func (c *PassengerCollector) getInstancesByPID(puns []string) ([]string, error)
 			c.logger.Debug("Skip PID that is not Passenger watchdog", "pid", proc.PID, "uid", uid, "cmdline", cmdline)
 			continue
 		}
-		pids = append(pids, strconv.Itoa(proc.PID))
+		instance := PassengerInstance{
+			PID:  strconv.Itoa(proc.PID),
+			UID:  uid,
+			User: getUsername(uid, c.logger),
+		}
+		instance.CoreStartTime = c.getCoreStartTime(instance)
+		instances = append(instances, instance)
 	}
-	return pids, nil
+	return instances, nil
 }
 
-func (c *PassengerCollector) getInstancesMetrics(ctx context.Context, instances []string) ([]PassengerAppMetrics, []error) {
+// getInstancesMetrics collects metrics from instances using a bounded number of workers.
+// Each instance gets a share of the Passenger timeout based on how many rounds
+// of workers are needed to collect every instance.
+func (c *PassengerCollector) getInstancesMetrics(ctx context.Context, instances []PassengerInstance) ([]PassengerAppMetrics, []error) {
 	wg := &sync.WaitGroup{}
 	var metrics []PassengerAppMetrics
-	var errors []error
-	wg.Add(len(instances))
-	for _, instance := range instances {
-		go func(inst string) {
-			c.logger.Debug("Collecting passenger instance metrics", "instance", inst)
+	var errs []error
+	if len(instances) == 0 {
+		return nil, nil
+	}
+	concurrency := min(max(*passengerConcurrency, 1), len(instances))
+	timeout := passengerInstanceTimeout(time.Duration(*passengerTimeout)*time.Second, len(instances), concurrency)
+	c.logger.Debug("Collecting passenger instances", "instances", len(instances), "concurrency", concurrency, "timeout", timeout)
+	jobs := make(chan *PassengerInstance)
+	wg.Add(concurrency)
+	for range concurrency {
+		go func() {
 			defer wg.Done()
-			m, err := c.getMetrics(ctx, inst)
-			if err != nil {
-				c.logger.Error(fmt.Sprintf("Error collecting %s instance metrics", inst), "err", err)
+			for inst := range jobs {
+				c.logger.Debug("Collecting passenger instance metrics", "instance", inst.PID)
+				instCtx, cancel := context.WithTimeout(ctx, timeout)
+				m, err := c.getMetrics(instCtx, inst)
+				if err == nil && instCtx.Err() != nil {
+					err = instCtx.Err()
+				}
+				cancel()
+				if err != nil {
+					c.logger.Error(fmt.Sprintf("Error collecting %s instance metrics", inst.PID), "err", err)
+					passengerMetricMutex.Lock()
+					errs = append(errs, &passengerInstanceError{instance: inst.PID, err: err})
+					passengerMetricMutex.Unlock()
+					continue
+				}
+				c.logger.Debug("DONE Collecting passenger instance metrics", "instance", inst.PID)
 				passengerMetricMutex.Lock()
-				errors = append(errors, err)
+				metrics = append(metrics, m...)
 				passengerMetricMutex.Unlock()
-				return
 			}
-			c.logger.Debug("DONE Collecting passenger instance metrics", "instance", inst)
-			passengerMetricMutex.Lock()
-			metrics = append(metrics, m...)
-			passengerMetricMutex.Unlock()
-		}(instance)
+		}()
 	}
+	for i := range instances {
+		jobs <- &instances[i]
+	}
+	close(jobs)
 	wg.Wait()
-	return metrics, errors
+	return metrics, errs
+}
+
+type passengerInstanceError struct {
+	instance string
+	err      error
+}
+
+func (e *passengerInstanceError) Error() string {
+	return fmt.Sprintf("instance %s: %s", e.instance, e.err)
+}
+
+func (e *passengerInstanceError) Unwrap() error {
+	return e.err
 }
 
-func (c *PassengerCollector) getMetrics(ctx context.Context, instance string) ([]PassengerAppMetrics, error) {
+func passengerInstanceTimeout(timeout time.Duration, instances int, concurrency int) time.Duration {
+	if instances == 0 || concurrency == 0 {
+		return timeout
+	}
+	rounds := (instances + concurrency - 1) / concurrency
+	return timeout / time.Duration(rounds)
+}
+
+func passengerErrorReason(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return passengerErrorTimeout
+	case errors.Is(err, errPassengerParse):
+		return passengerErrorParse
+	default:
+		return passengerErrorQuery
+	}
+}
+
+func (c *PassengerCollector) getMetrics(ctx context.Context, instance *PassengerInstance) ([]PassengerAppMetrics, error) {
 	now := timeNow().Unix()
 	c.logger.Debug("NOW", "now", now)
 	var metrics []PassengerAppMetrics
-	out, err := passengerStatusExecInstance(ctx, instance, c.logger)
+	out, err := c.getInstanceXML(ctx, instance)
 	if err != nil {
 		return nil, err
 	}
@@ -268,24 +565,50 @@ func (c *PassengerCollector) getMetrics(ctx context.Context, instance string) ([
 	decoder.CharsetReader = charset.NewReaderLabel
 	err = decoder.Decode(&info)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", errPassengerParse, err)
+	}
+	if info.PassengerVersion != "" {
+		instance.Version = info.PassengerVersion
 	}
 	if len(info.SuperGroups) == 0 {
-		c.logger.Warn("Supergroups is empty", "instance", instance)
+		c.logger.Warn("Supergroups is empty", "instance", instance.PID)
 		return nil, nil
 	}
+	// Fallback to the user Passenger reports when procfs did not identify the owner
+	if instance.UID == "" {
+		group := info.SuperGroups[0].Group
+		instance.UID = group.UID
+		instance.User = group.User
+	}
 	for _, s := range info.SuperGroups {
 		var metric PassengerAppMetrics
 		name := s.Group.AppRoot
 		metric.Name = name
+		metric.AppType = s.Group.AppType
+		metric.Environment = s.Group.Environment
+		metric.SpawnMethod = s.Group.SpawnMethod
+		metric.Instance = instance.PID
+		metric.UID = instance.UID
+		metric.User = instance.User
 		for _, p := range s.Group.Processes {
 			var processMetrics PassengerProcessMetrics
+			processMetrics.ID = p.Gupid
+			if processMetrics.ID == "" {
+				processMetrics.ID = fmt.Sprintf("%s/%d", instance.PID, p.PID)
+			}
 			processMetrics.RSS = p.RSS * 1024
 			processMetrics.CPU = float64(p.CPU) / float64(cores())
 			processMetrics.RealMemory = p.RealMemory * 1024
 			processMetrics.RequestsProcessed = p.RequestsProcessed
 			startTime := p.SpawnStartTime / microsecondsPerSecond
 			processMetrics.Runtime = now - startTime
+			if p.SpawnEndTime > p.SpawnStartTime {
+				processMetrics.SpawnDuration = float64(p.SpawnEndTime-p.SpawnStartTime) / microsecondsPerSecond
+			}
+			if p.LastUsed > 0 {
+				processMetrics.Idle = now - p.LastUsed/microsecondsPerSecond
+			}
+			c.getProcessStats(p, now, &processMetrics)
 			metric.Processes = append(metric.Processes, processMetrics)
 		}
 		metrics = append(metrics, metric)
@@ -293,6 +616,58 @@ func (c *PassengerCollector) getMetrics(ctx context.Context, instance string) ([
 	return metrics, nil
 }
 
+// getProcessStats reads CPU time, I/O and context switches of a Passenger process from procfs.
+// The process is skipped if it did not start when Passenger spawned it, which guards
+// against the PID having been reused by another process.
+// Processes spawned after the procfs snapshot are read on the next collection.
+func (c *PassengerCollector) getProcessStats(p PassengerProcess, now int64, metrics *PassengerProcessMetrics) {
+	if p.PID == 0 {
+		return
+	}
+	proc, ok := c.snapshot.Get(p.PID)
+	if !ok {
+		c.logger.Debug("Unable to find Passenger process", "pid", p.PID)
+		return
+	}
+	startTime := proc.StartTime
+	spawnStart := float64(p.SpawnStartTime) / microsecondsPerSecond
+	spawnEnd := float64(p.SpawnEndTime) / microsecondsPerSecond
+	if spawnEnd < spawnStart {
+		spawnEnd = float64(now)
+	}
+	if startTime < spawnStart-passengerSpawnTolerance || startTime > spawnEnd+passengerSpawnTolerance {
+		c.logger.Debug("Passenger process PID does not match spawn time", "pid", p.PID, "start", startTime, "spawn_start", spawnStart)
+		return
+	}
+	status, err := proc.NewStatus()
+	if err != nil {
+		c.logger.Debug("Unable to get Passenger process status", "pid", p.PID, "err", err)
+		return
+	}
+	metrics.ProcStats = true
+	metrics.CPUSeconds = proc.Stat.CPUTime()
+	metrics.VoluntaryCtxtSwitches = status.VoluntaryCtxtSwitches
+	metrics.NonVoluntaryCtxtSwitches = status.NonVoluntaryCtxtSwitches
+	io, err := proc.IO()
+	if err != nil {
+		c.logger.Debug("Unable to get Passenger process IO", "pid", p.PID, "err", err)
+		return
+	}
+	metrics.ReadBytes = io.ReadBytes
+	metrics.WriteBytes = io.WriteBytes
+}
+
+func (c *PassengerCollector) getInstanceXML(ctx context.Context, instance *PassengerInstance) (string, error) {
+	if instance.Dir != "" {
+		out, err := passengerCoreExec(ctx, instance.Dir, "/pool.xml")
+		if err == nil {
+			return out, nil
+		}
+		c.logger.Debug("Unable to query Passenger core API, using passenger-status", "instance", instance.PID, "err", err)
+	}
+	return passengerStatusExecInstance(ctx, instance.PID, c.logger)
+}
+
 func passengerStatusArgs(instance string) (string, []string) {
 	var command string
 	var args []string
@@ -313,6 +688,9 @@ func passengerStatusArgs(instance string) (string, []string) {
 func passengerStatus(ctx context.Context, instance string, logger *slog.Logger) (string, error) {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
+	if !fileExists(*passengerStatusPath) {
+		return "", fmt.Errorf("%s not found", *passengerStatusPath)
+	}
 	command, args := passengerStatusArgs(instance)
 	cmd := execCommand(ctx, command, args...)
 	cmd.Stdout = &stdout
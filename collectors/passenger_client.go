@@ -0,0 +1,183 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+const (
+	passengerCoreAPISocket = "agents.s/core_api"
+	passengerCorePIDFile   = "core.pid"
+	passengerROAdminUser   = "ro_admin"
+)
+
+var (
+	passengerNative       = kingpin.Flag("collector.passenger.native", "Query Passenger instances directly using the instance registry, falling back to passenger-status").Default("true").Envar("PASSENGER_NATIVE").Bool()
+	passengerRegistryFlag = kingpin.Flag("path.passenger-instance-registry", "Path to the Passenger instance registry directory, read from the rootfs").Default("/var/run/ondemand-passenger").Envar("PASSENGER_INSTANCE_REGISTRY_DIR").String()
+	passengerRegistryPath = "/var/run/ondemand-passenger"
+	passengerCoreExec     = passengerCoreAPI
+)
+
+type passengerProperties struct {
+	InstanceID       string `json:"instance_id"`
+	PassengerVersion string `json:"passenger_version"`
+	ServerSoftware   string `json:"server_software"`
+	WatchdogPID      int    `json:"watchdog_pid"`
+}
+
+// getRegistryInstances discovers Passenger instances from the properties.json files of the instance registry.
+func (c *PassengerCollector) getRegistryInstances(puns []string) ([]PassengerInstance, error) {
+	var instances []PassengerInstance
+	dirs, err := filepath.Glob(filepath.Join(passengerRegistryPath, "passenger.*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		data, err := os.ReadFile(filepath.Join(dir, "properties.json"))
+		if err != nil {
+			c.logger.Debug("Unable to read Passenger instance properties", "dir", dir, "err", err)
+			continue
+		}
+		var properties passengerProperties
+		if err := json.Unmarshal(data, &properties); err != nil {
+			c.logger.Debug("Unable to parse Passenger instance properties", "dir", dir, "err", err)
+			continue
+		}
+		name := properties.InstanceID
+		if name == "" {
+			name = strings.TrimPrefix(filepath.Base(dir), "passenger.")
+		}
+		instance := PassengerInstance{
+			Name:    name,
+			PID:     strconv.Itoa(properties.WatchdogPID),
+			Dir:     dir,
+			Version: properties.PassengerVersion,
+		}
+		instance.UID = c.getInstanceOwner(instance.PID, puns)
+		if instance.UID == "" {
+			instance.UID = getRegistryOwner(dir, puns)
+		}
+		if instance.UID != "" {
+			instance.User = getUsername(instance.UID, c.logger)
+			instance.CoreStartTime = c.getCoreStartTime(instance)
+		}
+		c.logger.Debug("Found Passenger instance in registry", "dir", dir, "name", name, "pid", instance.PID, "uid", instance.UID)
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+// getRegistryOwner returns the UID owning an instance directory if it is a PUN user.
+func getRegistryOwner(dir string, puns []string) string {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return ""
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	uid := strconv.FormatUint(uint64(stat.Uid), 10)
+	if !slices.Contains(puns, uid) {
+		return ""
+	}
+	return uid
+}
+
+// getCoreStartTime returns the start time of the Passenger core of an instance, or 0 if not found.
+func (c *PassengerCollector) getCoreStartTime(instance PassengerInstance) float64 {
+	if instance.Dir != "" {
+		if data, err := os.ReadFile(filepath.Join(instance.Dir, passengerCorePIDFile)); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+				if proc, ok := c.snapshot.Get(pid); ok && proc.UID == instance.UID {
+					return proc.StartTime
+				}
+			}
+		}
+	}
+	watchdog, err := strconv.Atoi(instance.PID)
+	if err != nil || c.snapshot == nil {
+		return 0
+	}
+	for _, proc := range c.snapshot.Procs {
+		if proc.PPID == watchdog && proc.UID == instance.UID && strings.TrimSpace(strings.Join(proc.Cmdline, " ")) == "Passenger core" {
+			return proc.StartTime
+		}
+	}
+	c.logger.Debug("Unable to find Passenger core process", "instance", instance.PID)
+	return 0
+}
+
+func passengerCoreClient(dir string) *http.Client {
+	socket := filepath.Join(dir, passengerCoreAPISocket)
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+// passengerCoreAPI requests path from the core API of a Passenger instance as the read only admin.
+func passengerCoreAPI(ctx context.Context, dir string, path string) (string, error) {
+	password, err := os.ReadFile(filepath.Join(dir, "read_only_admin_password.txt"))
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://localhost"+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(passengerROAdminUser, strings.TrimSpace(string(password)))
+	client := passengerCoreClient(dir)
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("status %s (%d): %s", resp.Status, resp.StatusCode, data)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,203 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/common/promslog"
+)
+
+func setupPassengerRegistry(t *testing.T, instances map[string]int) string {
+	registry := t.TempDir()
+	for name, pid := range instances {
+		dir := filepath.Join(registry, "passenger."+name)
+		if err := os.MkdirAll(filepath.Join(dir, "agents.s"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		properties := fmt.Sprintf(`{"instance_id":"%s","passenger_version":"6.0.4","watchdog_pid":%d}`, name, pid)
+		if err := os.WriteFile(filepath.Join(dir, "properties.json"), []byte(properties), 0644); err != nil {
+			t.Fatal(err)
+		}
+		password := "secret-" + name
+		if err := os.WriteFile(filepath.Join(dir, "read_only_admin_password.txt"), []byte(password+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fixtureData := readFixture(fmt.Sprintf("passenger-status-%d.out", pid))
+		listener, err := net.Listen("unix", filepath.Join(dir, passengerCoreAPISocket))
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			username, pass, ok := req.BasicAuth()
+			if !ok || username != passengerROAdminUser || pass != password {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if req.URL.Path != "/pool.xml" {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = rw.Write([]byte(fixtureData))
+		}))
+		server.Listener = listener
+		server.Start()
+		t.Cleanup(server.Close)
+	}
+	return registry
+}
+
+func TestGetRegistryInstances(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	registry := setupPassengerRegistry(t, map[string]int{"4PFqSPuH": 57564, "YxgQTchg": 97758})
+	passengerRegistryPath = registry
+	collector := NewPassengerCollector(promslog.NewNopLogger())
+	collector.snapshot = getTestSnapshot(t)
+	instances, err := collector.getRegistryInstances([]string{"32666"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(instances) != 2 {
+		t.Fatalf("Unexpected count of instances: %d", len(instances))
+	}
+	expected := PassengerInstance{Name: "4PFqSPuH", PID: "57564", Dir: filepath.Join(registry, "passenger.4PFqSPuH"), Version: "6.0.4"}
+	if instances[0] != expected {
+		t.Errorf("Unexpected instance\nExpected\n%v\nGot\n%v", expected, instances[0])
+	}
+}
+
+func TestPassengerCoreAPI(t *testing.T) {
+	registry := setupPassengerRegistry(t, map[string]int{"4PFqSPuH": 57564})
+	dir := filepath.Join(registry, "passenger.4PFqSPuH")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	out, err := passengerCoreAPI(ctx, dir, "/pool.xml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if out != readFixture("passenger-status-57564.out") {
+		t.Errorf("Unexpected output: %s", out)
+	}
+	if _, err := passengerCoreAPI(ctx, dir, "/foo"); err == nil {
+		t.Errorf("Expected error requesting unknown path")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "read_only_admin_password.txt"), []byte("wrong"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := passengerCoreAPI(ctx, dir, "/pool.xml"); err == nil {
+		t.Errorf("Expected error with invalid password")
+	}
+}
+
+func TestGetInstancesMetricsRegistry(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	registry := setupPassengerRegistry(t, map[string]int{"4PFqSPuH": 57564, "YxgQTchg": 97758})
+	passengerRegistryPath = registry
+	passengerStatusExec = func(ctx context.Context, instance string, logger *slog.Logger) (string, error) {
+		return "", fmt.Errorf("passenger-status should not be executed")
+	}
+	passengerStatusExecInstance = passengerStatusExec
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collector := NewPassengerCollector(promslog.NewNopLogger())
+	collector.snapshot = getTestSnapshot(t)
+	instances, err := collector.getInstances([]string{"32666"}, ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	metrics, errors := collector.getInstancesMetrics(ctx, instances)
+	if errors != nil {
+		t.Fatalf("Unexpected errors: %v", errors)
+	}
+	if len(metrics) != 3 {
+		t.Errorf("Unexpected count of app metrics: %d", len(metrics))
+	}
+	if instances[1].User != "lihaoran36" {
+		t.Errorf("Unexpected instance user: %s", instances[1].User)
+	}
+}
+
+func TestGetInstancesRegistryFallback(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	registry := t.TempDir()
+	passengerRegistryPath = registry
+	passengerStatusExec = func(ctx context.Context, instance string, logger *slog.Logger) (string, error) {
+		return readFixture("passenger-status.out"), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collector := NewPassengerCollector(promslog.NewNopLogger())
+	collector.snapshot = getTestSnapshot(t)
+	instances, err := collector.getInstances([]string{"32666"}, ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(instances) != 2 {
+		t.Errorf("Unexpected count of instances: %d", len(instances))
+	}
+	for _, instance := range instances {
+		if instance.Dir != "" {
+			t.Errorf("Unexpected registry instance: %v", instance)
+		}
+	}
+}
+
+func TestGetCoreStartTime(t *testing.T) {
+	collector := NewPassengerCollector(promslog.NewNopLogger())
+	collector.snapshot = getTestSnapshot(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, passengerCorePIDFile), []byte("71816\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		instance PassengerInstance
+		expected string
+	}{
+		{"core.pid", PassengerInstance{PID: "57564", UID: "32666", Dir: dir}, "1587044261.49"},
+		{"core.pid of another user", PassengerInstance{PID: "57564", UID: "20821", Dir: dir}, "0.00"},
+		{"child of watchdog", PassengerInstance{PID: "71813", UID: "32666"}, "1587044261.49"},
+		{"no core", PassengerInstance{PID: "57564", UID: "32666"}, "0.00"},
+	}
+	for _, test := range tests {
+		if val := fmt.Sprintf("%.2f", collector.getCoreStartTime(test.instance)); val != test.expected {
+			t.Errorf("Unexpected core start time for %s, expected %s, got %s", test.name, test.expected, val)
+		}
+	}
+}
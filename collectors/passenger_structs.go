@@ -23,7 +23,8 @@
 package collectors
 
 type PassengerInfo struct {
-	SuperGroups []PassengerSuperGroup `xml:"supergroups>supergroup"`
+	PassengerVersion string                `xml:"passenger_version"`
+	SuperGroups      []PassengerSuperGroup `xml:"supergroups>supergroup"`
 }
 
 type PassengerSuperGroup struct {
@@ -31,14 +32,23 @@ type PassengerSuperGroup struct {
 }
 
 type PassengerGroup struct {
-	AppRoot   string             `xml:"app_root"`
-	Processes []PassengerProcess `xml:"processes>process"`
+	AppRoot     string             `xml:"app_root"`
+	AppType     string             `xml:"app_type"`
+	Environment string             `xml:"environment"`
+	SpawnMethod string             `xml:"options>spawn_method"`
+	User        string             `xml:"user"`
+	UID         string             `xml:"uid"`
+	Processes   []PassengerProcess `xml:"processes>process"`
 }
 
 type PassengerProcess struct {
-	RSS               int   `xml:"rss"`
-	CPU               int   `xml:"cpu"`
-	RealMemory        int   `xml:"real_memory"`
-	RequestsProcessed int   `xml:"processed"`
-	SpawnStartTime    int64 `xml:"spawn_start_time"`
+	PID               int    `xml:"pid"`
+	Gupid             string `xml:"gupid"`
+	RSS               int    `xml:"rss"`
+	CPU               int    `xml:"cpu"`
+	RealMemory        int    `xml:"real_memory"`
+	RequestsProcessed int    `xml:"processed"`
+	SpawnStartTime    int64  `xml:"spawn_start_time"`
+	SpawnEndTime      int64  `xml:"spawn_end_time"`
+	LastUsed          int64  `xml:"last_used"`
 }
@@ -24,14 +24,20 @@ package collectors
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"os"
+	"os/user"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/promslog"
 )
 
@@ -43,6 +49,7 @@ func TestGetInstances(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	collector := NewPassengerCollector(logger)
+	collector.snapshot = getTestSnapshot(t)
 	m, err := collector.getInstances([]string{"32666", "20821"}, ctx)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
@@ -50,6 +57,11 @@ func TestGetInstances(t *testing.T) {
 	}
 	if len(m) != 2 {
 		t.Errorf("Unexpected count of instances: %d", len(m))
+		return
+	}
+	expected := []PassengerInstance{{Name: "4PFqSPuH", PID: "57564", Version: "6.0.4"}, {Name: "YxgQTchg", PID: "97758", Version: "6.0.4"}}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Unexpected instances\nExpected\n%v\nGot\n%v", expected, m)
 	}
 }
 
@@ -62,8 +74,17 @@ func TestGetInstancesOne(t *testing.T) {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	lookupUserID = func(uid string) (*user.User, error) {
+		return &user.User{Uid: uid, Username: "msqueo"}, nil
+	}
+	userLookups = newUserLookupCache()
+	defer func() {
+		lookupUserID = user.LookupId
+		userLookups = newUserLookupCache()
+	}()
 	logger := promslog.NewNopLogger()
 	collector := NewPassengerCollector(logger)
+	collector.snapshot = getTestSnapshot(t)
 	m, err := collector.getInstances([]string{"32666"}, ctx)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
@@ -71,6 +92,177 @@ func TestGetInstancesOne(t *testing.T) {
 	}
 	if len(m) != 1 {
 		t.Errorf("Unexpected count of instances: %d", len(m))
+		return
+	}
+	expected := PassengerInstance{PID: "71813", UID: "32666", User: "msqueo", CoreStartTime: 1587044261.49}
+	if m[0] != expected {
+		t.Errorf("Unexpected instance\nExpected\n%v\nGot\n%v", expected, m[0])
+	}
+}
+
+func TestPassengerCollectorPerUser(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.passenger.per-user"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	tmpDir := t.TempDir()
+	passengerStatus := tmpDir + "/ondemand-passenger-status"
+	if err := os.WriteFile(passengerStatus, []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	passengerStatusPath = &passengerStatus
+	passengerTracker = newPassengerProcessTracker()
+	passengerStatusExec = func(ctx context.Context, instance string, logger *slog.Logger) (string, error) {
+		return readFixture("passenger-status.out"), nil
+	}
+	passengerStatusExecInstance = func(ctx context.Context, instance string, logger *slog.Logger) (string, error) {
+		return readFixture(fmt.Sprintf("passenger-status-%s.out", instance)), nil
+	}
+	expected := `
+		# HELP ondemand_passenger_instances_by_user Number of Passenger instances owned by a user
+		# TYPE ondemand_passenger_instances_by_user gauge
+		ondemand_passenger_instances_by_user{user="lihaoran36"} 1
+		ondemand_passenger_instances_by_user{user="osu10579"} 1
+		# HELP ondemand_passenger_user_app_processes Process count of an app for a user
+		# TYPE ondemand_passenger_user_app_processes gauge
+		ondemand_passenger_user_app_processes{app="/var/www/ood/apps/sys/dashboard",user="lihaoran36"} 1
+		ondemand_passenger_user_app_processes{app="/var/www/ood/apps/sys/dashboard",user="osu10579"} 1
+		ondemand_passenger_user_app_processes{app="/var/www/ood/apps/sys/files",user="osu10579"} 1
+		# HELP ondemand_passenger_user_app_requests_total Requests made to passenger apps for a user
+		# TYPE ondemand_passenger_user_app_requests_total counter
+		ondemand_passenger_user_app_requests_total{app="/var/www/ood/apps/sys/dashboard",user="lihaoran36"} 122
+		ondemand_passenger_user_app_requests_total{app="/var/www/ood/apps/sys/dashboard",user="osu10579"} 220
+		ondemand_passenger_user_app_requests_total{app="/var/www/ood/apps/sys/files",user="osu10579"} 10
+	`
+	collector := NewPassengerCollector(promslog.NewNopLogger())
+	collector.snapshot = getTestSnapshot(t)
+	c := funcCollector(func(ch chan<- prometheus.Metric) {
+		_ = collector.collect(collector.snapshot, []string{"foo"}, defaultNginxStageConfig, ch)
+	})
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_passenger_instances_by_user",
+		"ondemand_passenger_user_app_processes", "ondemand_passenger_user_app_requests_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestGetInstancesMetricsPartial(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.passenger.timeout=1", "--collector.passenger.concurrency=1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	passengerStatusExecInstance = func(ctx context.Context, instance string, logger *slog.Logger) (string, error) {
+		switch instance {
+		case "57564":
+			return readFixture("passenger-status-57564.out"), nil
+		case "97758":
+			return "<?xml", nil
+		case "1":
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("unknown instance %s", instance)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	instances := []PassengerInstance{{PID: "1"}, {PID: "57564"}, {PID: "97758"}, {PID: "2"}}
+	collector := NewPassengerCollector(promslog.NewNopLogger())
+	collector.snapshot = getTestSnapshot(t)
+	start := time.Now()
+	metrics, errs := collector.getInstancesMetrics(ctx, instances)
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Instance timeout not applied, took %s", elapsed)
+	}
+	if len(metrics) != 2 {
+		t.Errorf("Unexpected count of app metrics: %d", len(metrics))
+	}
+	reasons := make(map[string]int)
+	for _, err := range errs {
+		reasons[passengerErrorReason(err)]++
+	}
+	expected := map[string]int{passengerErrorTimeout: 1, passengerErrorParse: 1, passengerErrorQuery: 1}
+	if !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("Unexpected error reasons\nExpected\n%v\nGot\n%v", expected, reasons)
+	}
+}
+
+func TestPassengerInstanceTimeout(t *testing.T) {
+	tests := []struct {
+		instances   int
+		concurrency int
+		expected    time.Duration
+	}{
+		{instances: 0, concurrency: 10, expected: 30 * time.Second},
+		{instances: 5, concurrency: 10, expected: 30 * time.Second},
+		{instances: 11, concurrency: 10, expected: 15 * time.Second},
+		{instances: 30, concurrency: 10, expected: 10 * time.Second},
+	}
+	for _, test := range tests {
+		if val := passengerInstanceTimeout(30*time.Second, test.instances, test.concurrency); val != test.expected {
+			t.Errorf("Unexpected timeout for %d instances, expected %s, got %s", test.instances, test.expected, val)
+		}
+	}
+}
+
+func TestPassengerCollectorInstanceInfo(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	procFS = filepath.Join(dir, "../fixtures/proc")
+	passengerStatusExec = func(ctx context.Context, instance string, logger *slog.Logger) (string, error) {
+		return readFixture("passenger-status-57564.out"), nil
+	}
+	passengerStatusExecInstance = passengerStatusExec
+	timeNow = func() time.Time {
+		mockNow, _ := time.Parse("01/02/2006", "04/17/2020")
+		return mockNow
+	}
+	expected := `
+		# HELP ondemand_passenger_info Number of Passenger instances running a Passenger version
+		# TYPE ondemand_passenger_info gauge
+		ondemand_passenger_info{version="6.0.4"} 1
+		# HELP ondemand_passenger_instance_uptime_seconds Seconds since the Passenger core of an instance started
+		# TYPE ondemand_passenger_instance_uptime_seconds gauge
+		ondemand_passenger_instance_uptime_seconds{instance="71813"} 37338.50999999046
+	`
+	collector := NewPassengerCollector(promslog.NewNopLogger())
+	collector.snapshot = getTestSnapshot(t)
+	c := funcCollector(func(ch chan<- prometheus.Metric) {
+		_ = collector.collect(collector.snapshot, []string{"32666"}, defaultNginxStageConfig, ch)
+	})
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_passenger_info",
+		"ondemand_passenger_instance_uptime_seconds"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestGetProcessStats(t *testing.T) {
+	collector := NewPassengerCollector(promslog.NewNopLogger())
+	collector.snapshot = getTestSnapshot(t)
+	process := PassengerProcess{PID: 57625, SpawnStartTime: 1587044800733313, SpawnEndTime: 1587044802504738}
+	var metrics PassengerProcessMetrics
+	collector.getProcessStats(process, 1587081600, &metrics)
+	expected := PassengerProcessMetrics{ProcStats: true, CPUSeconds: 18, ReadBytes: 4096000, WriteBytes: 81920,
+		VoluntaryCtxtSwitches: 2000, NonVoluntaryCtxtSwitches: 150}
+	if metrics != expected {
+		t.Errorf("Unexpected process stats\nExpected\n%v\nGot\n%v", expected, metrics)
+	}
+	// PID reused by a process started long after Passenger spawned the app
+	process.SpawnStartTime = 1587000000000000
+	process.SpawnEndTime = 1587000001000000
+	metrics = PassengerProcessMetrics{}
+	collector.getProcessStats(process, 1587081600, &metrics)
+	if metrics.ProcStats {
+		t.Errorf("Expected process with reused PID to be skipped")
 	}
 }
 
@@ -0,0 +1,233 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	passengerTracker      = newPassengerProcessTracker()
+	passengerAppRetention = kingpin.Flag("collector.passenger.app-retention", "Duration to keep the counters of a Passenger app without processes").Default("1h").Envar("PASSENGER_APP_RETENTION").Duration()
+)
+
+type passengerTrackedProcess struct {
+	app       string
+	instance  string
+	user      string
+	totals    PassengerProcessTotals
+	procStats bool
+}
+
+// PassengerProcessTotals are cumulative values of processes kept for an app after the processes exit.
+type PassengerProcessTotals struct {
+	Requests                 int
+	CPUSeconds               float64
+	ReadBytes                uint64
+	WriteBytes               uint64
+	VoluntaryCtxtSwitches    uint64
+	NonVoluntaryCtxtSwitches uint64
+}
+
+func (t *PassengerProcessTotals) add(o PassengerProcessTotals) {
+	t.Requests += o.Requests
+	t.CPUSeconds += o.CPUSeconds
+	t.ReadBytes += o.ReadBytes
+	t.WriteBytes += o.WriteBytes
+	t.VoluntaryCtxtSwitches += o.VoluntaryCtxtSwitches
+	t.NonVoluntaryCtxtSwitches += o.NonVoluntaryCtxtSwitches
+}
+
+// PassengerAppCounters are per app counters that remain monotonic as Passenger processes spawn and exit.
+type PassengerAppCounters struct {
+	PassengerProcessTotals
+	Spawned        int
+	Exited         int
+	ProcStats      bool
+	SpawnDurations Histogram
+	UserRequests   map[string]int
+}
+
+// passengerProcessTracker remembers Passenger processes by gupid.
+type passengerProcessTracker struct {
+	sync.Mutex
+	processes      map[string]passengerTrackedProcess
+	spawned        map[string]int
+	exited         map[string]int
+	exitedTotals   map[string]PassengerProcessTotals
+	procStats      map[string]bool
+	spawnDurations map[string]*Histogram
+	userRequests   map[string]map[string]int
+	lastSeen       map[string]time.Time
+}
+
+func newPassengerProcessTracker() *passengerProcessTracker {
+	return &passengerProcessTracker{
+		processes:      make(map[string]passengerTrackedProcess),
+		spawned:        make(map[string]int),
+		exited:         make(map[string]int),
+		exitedTotals:   make(map[string]PassengerProcessTotals),
+		procStats:      make(map[string]bool),
+		spawnDurations: make(map[string]*Histogram),
+		userRequests:   make(map[string]map[string]int),
+		lastSeen:       make(map[string]time.Time),
+	}
+}
+
+// update records the processes seen in a collection and returns the counters of every app.
+func (t *passengerProcessTracker) update(instances []PassengerInstance, failed []string, metrics []PassengerAppMetrics, now time.Time, retention time.Duration) map[string]PassengerAppCounters {
+	t.Lock()
+	defer t.Unlock()
+	running := make(map[string]bool)
+	for _, instance := range instances {
+		running[instance.PID] = true
+	}
+	for _, instance := range failed {
+		running[instance] = false
+	}
+	seen := make(map[string]bool)
+	for _, m := range metrics {
+		for _, p := range m.Processes {
+			if p.ID == "" {
+				continue
+			}
+			seen[p.ID] = true
+			if _, ok := t.processes[p.ID]; !ok {
+				t.spawned[m.Name]++
+				t.observeSpawn(m.Name, p.SpawnDuration)
+			}
+			tracked := passengerTrackedProcess{
+				app:      m.Name,
+				instance: m.Instance,
+				user:     m.User,
+				totals: PassengerProcessTotals{
+					Requests:                 p.RequestsProcessed,
+					CPUSeconds:               p.CPUSeconds,
+					ReadBytes:                p.ReadBytes,
+					WriteBytes:               p.WriteBytes,
+					VoluntaryCtxtSwitches:    p.VoluntaryCtxtSwitches,
+					NonVoluntaryCtxtSwitches: p.NonVoluntaryCtxtSwitches,
+				},
+				procStats: p.ProcStats,
+			}
+			// Keep the last values read from procfs if the process could not be read this time
+			if previous, ok := t.processes[p.ID]; ok && previous.procStats && !p.ProcStats {
+				requests := tracked.totals.Requests
+				tracked.totals = previous.totals
+				tracked.totals.Requests = requests
+				tracked.procStats = true
+			}
+			if tracked.procStats {
+				t.procStats[m.Name] = true
+			}
+			t.processes[p.ID] = tracked
+		}
+	}
+	for id, p := range t.processes {
+		if seen[id] {
+			continue
+		}
+		if collected, ok := running[p.instance]; ok && !collected {
+			continue
+		}
+		t.exited[p.app]++
+		totals := t.exitedTotals[p.app]
+		totals.add(p.totals)
+		t.exitedTotals[p.app] = totals
+		if p.user != "" {
+			if _, ok := t.userRequests[p.app]; !ok {
+				t.userRequests[p.app] = make(map[string]int)
+			}
+			t.userRequests[p.app][p.user] += p.totals.Requests
+		}
+		delete(t.processes, id)
+	}
+	for _, p := range t.processes {
+		t.lastSeen[p.app] = now
+	}
+	for app := range t.spawned {
+		if lastSeen, ok := t.lastSeen[app]; !ok || now.Sub(lastSeen) > retention {
+			t.forget(app)
+		}
+	}
+	counters := make(map[string]PassengerAppCounters)
+	for app, spawned := range t.spawned {
+		spawnDurations := newHistogram(passengerSpawnBuckets)
+		if h, ok := t.spawnDurations[app]; ok {
+			spawnDurations = h.copy()
+		}
+		counters[app] = PassengerAppCounters{
+			PassengerProcessTotals: t.exitedTotals[app],
+			Spawned:                spawned,
+			Exited:                 t.exited[app],
+			ProcStats:              t.procStats[app],
+			SpawnDurations:         spawnDurations,
+		}
+		if users, ok := t.userRequests[app]; ok {
+			c := counters[app]
+			c.UserRequests = make(map[string]int)
+			for user, requests := range users {
+				c.UserRequests[user] = requests
+			}
+			counters[app] = c
+		}
+	}
+	for _, p := range t.processes {
+		c := counters[p.app]
+		c.add(p.totals)
+		if p.user != "" {
+			if c.UserRequests == nil {
+				c.UserRequests = make(map[string]int)
+			}
+			c.UserRequests[p.user] += p.totals.Requests
+		}
+		counters[p.app] = c
+	}
+	return counters
+}
+
+func (t *passengerProcessTracker) forget(app string) {
+	delete(t.spawned, app)
+	delete(t.exited, app)
+	delete(t.exitedTotals, app)
+	delete(t.procStats, app)
+	delete(t.spawnDurations, app)
+	delete(t.userRequests, app)
+	delete(t.lastSeen, app)
+}
+
+func (t *passengerProcessTracker) observeSpawn(app string, duration float64) {
+	if duration <= 0 {
+		return
+	}
+	h, ok := t.spawnDurations[app]
+	if !ok {
+		histogram := newHistogram(passengerSpawnBuckets)
+		h = &histogram
+		t.spawnDurations[app] = h
+	}
+	h.observe(duration)
+}
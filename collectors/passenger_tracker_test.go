@@ -0,0 +1,169 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPassengerProcessTracker(t *testing.T) {
+	tracker := newPassengerProcessTracker()
+	now := time.Unix(1587100000, 0)
+	dashboard := "/var/www/ood/apps/sys/dashboard"
+	files := "/var/www/ood/apps/sys/files"
+	instances := []PassengerInstance{{PID: "1"}, {PID: "2"}}
+	metrics := []PassengerAppMetrics{
+		{Name: dashboard, Instance: "1", Processes: []PassengerProcessMetrics{{ID: "a", RequestsProcessed: 10, SpawnDuration: 1.5}}},
+		{Name: files, Instance: "2", Processes: []PassengerProcessMetrics{{ID: "b", RequestsProcessed: 5}}},
+	}
+	counters := withoutSpawnDurations(tracker.update(instances, nil, metrics, now, time.Hour))
+	expected := map[string]PassengerAppCounters{
+		dashboard: {Spawned: 1, PassengerProcessTotals: PassengerProcessTotals{Requests: 10}},
+		files:     {Spawned: 1, PassengerProcessTotals: PassengerProcessTotals{Requests: 5}},
+	}
+	if !reflect.DeepEqual(counters, expected) {
+		t.Errorf("Unexpected counters\nExpected\n%v\nGot\n%v", expected, counters)
+	}
+	// Dashboard process recycled, files instance failed to collect
+	metrics = []PassengerAppMetrics{
+		{Name: dashboard, Instance: "1", Processes: []PassengerProcessMetrics{{ID: "c", RequestsProcessed: 2, SpawnDuration: 6}}},
+	}
+	counters = withoutSpawnDurations(tracker.update(instances, []string{"2"}, metrics, now, time.Hour))
+	expected = map[string]PassengerAppCounters{
+		dashboard: {Spawned: 2, Exited: 1, PassengerProcessTotals: PassengerProcessTotals{Requests: 12}},
+		files:     {Spawned: 1, PassengerProcessTotals: PassengerProcessTotals{Requests: 5}},
+	}
+	if !reflect.DeepEqual(counters, expected) {
+		t.Errorf("Unexpected counters\nExpected\n%v\nGot\n%v", expected, counters)
+	}
+	// Files instance is gone
+	all := tracker.update(instances[:1], nil, metrics, now, time.Hour)
+	counters = withoutSpawnDurations(all)
+	expected = map[string]PassengerAppCounters{
+		dashboard: {Spawned: 2, Exited: 1, PassengerProcessTotals: PassengerProcessTotals{Requests: 12}},
+		files:     {Spawned: 1, Exited: 1, PassengerProcessTotals: PassengerProcessTotals{Requests: 5}},
+	}
+	if !reflect.DeepEqual(counters, expected) {
+		t.Errorf("Unexpected counters\nExpected\n%v\nGot\n%v", expected, counters)
+	}
+	spawn := all[dashboard].SpawnDurations
+	if spawn.Count != 2 || spawn.Sum != 7.5 {
+		t.Errorf("Unexpected spawn durations count %d sum %v", spawn.Count, spawn.Sum)
+	}
+	if spawn.Buckets[1] != 0 || spawn.Buckets[2] != 1 || spawn.Buckets[10] != 2 {
+		t.Errorf("Unexpected spawn duration buckets: %v", spawn.Buckets)
+	}
+	if all[files].ProcStats {
+		t.Errorf("Unexpected procfs stats for files")
+	}
+	if spawn := all[files].SpawnDurations; spawn.Count != 0 || len(spawn.Buckets) != len(passengerSpawnBuckets) {
+		t.Errorf("Unexpected spawn durations for files: %v", spawn)
+	}
+}
+
+func withoutSpawnDurations(counters map[string]PassengerAppCounters) map[string]PassengerAppCounters {
+	stripped := make(map[string]PassengerAppCounters)
+	for app, c := range counters {
+		c.SpawnDurations = Histogram{}
+		stripped[app] = c
+	}
+	return stripped
+}
+
+func TestPassengerProcessTrackerProcStats(t *testing.T) {
+	tracker := newPassengerProcessTracker()
+	now := time.Unix(1587100000, 0)
+	dashboard := "/var/www/ood/apps/sys/dashboard"
+	instances := []PassengerInstance{{PID: "1"}}
+	metrics := []PassengerAppMetrics{
+		{Name: dashboard, Instance: "1", Processes: []PassengerProcessMetrics{
+			{ID: "a", ProcStats: true, CPUSeconds: 10, ReadBytes: 100, WriteBytes: 10, VoluntaryCtxtSwitches: 5},
+			{ID: "b", ProcStats: true, CPUSeconds: 1, ReadBytes: 1, WriteBytes: 1, NonVoluntaryCtxtSwitches: 1},
+		}},
+	}
+	tracker.update(instances, nil, metrics, now, time.Hour)
+	// Process a exits, process b could not be read from procfs
+	metrics = []PassengerAppMetrics{
+		{Name: dashboard, Instance: "1", Processes: []PassengerProcessMetrics{{ID: "b", RequestsProcessed: 3}}},
+	}
+	counters := tracker.update(instances, nil, metrics, now, time.Hour)
+	expected := PassengerProcessTotals{Requests: 3, CPUSeconds: 11, ReadBytes: 101, WriteBytes: 11,
+		VoluntaryCtxtSwitches: 5, NonVoluntaryCtxtSwitches: 1}
+	if counters[dashboard].PassengerProcessTotals != expected {
+		t.Errorf("Unexpected totals\nExpected\n%v\nGot\n%v", expected, counters[dashboard].PassengerProcessTotals)
+	}
+	if !counters[dashboard].ProcStats {
+		t.Errorf("Expected procfs stats for dashboard")
+	}
+}
+
+func TestPassengerProcessTrackerRetention(t *testing.T) {
+	tracker := newPassengerProcessTracker()
+	now := time.Unix(1587100000, 0)
+	dashboard := "/var/www/ood/apps/sys/dashboard"
+	sandbox := "/home/foo/ondemand/dev/myapp"
+	instances := []PassengerInstance{{PID: "1"}, {PID: "2"}}
+	metrics := []PassengerAppMetrics{
+		{Name: dashboard, Instance: "1", Processes: []PassengerProcessMetrics{{ID: "a", RequestsProcessed: 10}}},
+		{Name: sandbox, Instance: "2", Processes: []PassengerProcessMetrics{{ID: "b", RequestsProcessed: 5}}},
+	}
+	tracker.update(instances, nil, metrics, now, time.Hour)
+	// Sandbox app exits, its counters are kept within the retention
+	metrics = metrics[:1]
+	counters := tracker.update(instances[:1], nil, metrics, now.Add(30*time.Minute), time.Hour)
+	if c, ok := counters[sandbox]; !ok || c.Exited != 1 || c.Requests != 5 {
+		t.Errorf("Unexpected counters for sandbox app within retention: %v", c)
+	}
+	// Failed instances keep the processes of their apps alive
+	counters = tracker.update(instances[:1], []string{"1"}, nil, now.Add(3*time.Hour), time.Hour)
+	if _, ok := counters[dashboard]; !ok {
+		t.Errorf("Expected counters for dashboard with a failed instance")
+	}
+	if _, ok := counters[sandbox]; ok {
+		t.Errorf("Unexpected counters for sandbox app after retention")
+	}
+	if len(tracker.spawned) != 1 || len(tracker.lastSeen) != 1 || len(tracker.exited) != 0 || len(tracker.exitedTotals) != 0 {
+		t.Errorf("Unexpected apps kept by the tracker: spawned %v lastSeen %v exited %v", tracker.spawned, tracker.lastSeen, tracker.exited)
+	}
+}
+
+func TestPassengerProcessTrackerUserRequests(t *testing.T) {
+	tracker := newPassengerProcessTracker()
+	now := time.Unix(1587100000, 0)
+	dashboard := "/var/www/ood/apps/sys/dashboard"
+	instances := []PassengerInstance{{PID: "1"}, {PID: "2"}}
+	metrics := []PassengerAppMetrics{
+		{Name: dashboard, Instance: "1", User: "foo", Processes: []PassengerProcessMetrics{{ID: "a", RequestsProcessed: 10}}},
+		{Name: dashboard, Instance: "2", User: "bar", Processes: []PassengerProcessMetrics{{ID: "b", RequestsProcessed: 5}}},
+	}
+	tracker.update(instances, nil, metrics, now, time.Hour)
+	// The dashboard of foo is recycled
+	metrics[0].Processes = []PassengerProcessMetrics{{ID: "c", RequestsProcessed: 2}}
+	counters := tracker.update(instances, nil, metrics, now, time.Hour)
+	expected := map[string]int{"foo": 12, "bar": 5}
+	if !reflect.DeepEqual(counters[dashboard].UserRequests, expected) {
+		t.Errorf("Unexpected user requests\nExpected\n%v\nGot\n%v", expected, counters[dashboard].UserRequests)
+	}
+}
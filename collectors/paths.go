@@ -0,0 +1,247 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	procfsPath     = kingpin.Flag("path.procfs", "procfs mountpoint").Default("/proc").Envar("PROCFS_PATH").String()
+	sysfsPath      = kingpin.Flag("path.sysfs", "sysfs mountpoint").Default("/sys").Envar("SYSFS_PATH").String()
+	rootfsPath     = kingpin.Flag("path.rootfs", "Root filesystem of the host, used to read users and OnDemand configuration").Default("/").Envar("ROOTFS_PATH").String()
+	rootFS         = "/"
+	mountinfoPath  = "/proc/self/mountinfo"
+	selfUIDMapPath = "/proc/self/uid_map"
+	// Values of the hidepid mount option of procfs, see proc(5)
+	hidepidModes = map[string]float64{
+		"0": 0, "off": 0,
+		"1": 1, "noaccess": 1,
+		"2": 2, "invisible": 2,
+		"4": 4, "ptraceable": 4,
+	}
+)
+
+// ConfigurePaths applies the path flags, it must be called after the flags are parsed.
+func ConfigurePaths(logger *slog.Logger) {
+	procFS = *procfsPath
+	cgroupFS = filepath.Join(*sysfsPath, "fs/cgroup")
+	rootFS = *rootfsPath
+	oodPortalPath = rootfsFilePath("etc/ood/config/ood_portal.yml")
+	nginxStageConfigPath = rootfsFilePath(*nginxStageConfigFlag)
+	passengerRegistryPath = rootfsFilePath(*passengerRegistryFlag)
+	if rootFS != "/" {
+		lookupUserID = lookupRootfsUserID
+		lookupUser = lookupRootfsUser
+		lookupGroupID = lookupRootfsGroupID
+		lookupGroupIDs = lookupRootfsGroupIDs
+	}
+	if !identityUIDMap(selfUIDMapPath, logger) {
+		logger.Warn("Exporter runs in a user namespace, UIDs of PUN processes in procfs may not match the users of the host", "path", selfUIDMapPath)
+	}
+	logger.Debug("Configured paths", "procfs", procFS, "cgroupfs", cgroupFS, "rootfs", rootFS)
+}
+
+func rootfsFilePath(name string) string {
+	return filepath.Join(rootFS, name)
+}
+
+// identityUIDMap returns false when the uid_map maps UIDs other than all UIDs to themselves.
+func identityUIDMap(path string, logger *slog.Logger) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Debug("Unable to read uid_map", "path", path, "err", err)
+		return true
+	}
+	fields := strings.Fields(string(data))
+	return len(fields) == 3 && fields[0] == "0" && fields[1] == "0" && fields[2] == "4294967295"
+}
+
+// lookupRootfsUserID looks up uid in the passwd file of the rootfs, falling back to NSS.
+func lookupRootfsUserID(uid string) (*user.User, error) {
+	u, err := lookupPasswd(rootfsFilePath("etc/passwd"), func(u *user.User) bool { return u.Uid == uid })
+	if err == nil && u != nil {
+		return u, nil
+	}
+	return user.LookupId(uid)
+}
+
+// lookupRootfsUser looks up username in the passwd file of the rootfs before using NSS.
+func lookupRootfsUser(username string) (*user.User, error) {
+	u, err := lookupPasswd(rootfsFilePath("etc/passwd"), func(u *user.User) bool { return u.Username == username })
+	if err == nil && u != nil {
+		return u, nil
+	}
+	return user.Lookup(username)
+}
+
+// lookupPasswd returns the first user of a passwd file that matches or nil if none match.
+func lookupPasswd(path string, match func(*user.User) bool) (*user.User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 {
+			continue
+		}
+		u := &user.User{Username: fields[0], Uid: fields[2], Gid: fields[3], Name: fields[4], HomeDir: fields[5]}
+		if match(u) {
+			return u, nil
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// lookupRootfsGroupID looks up the group of gid in the group file of the rootfs before using NSS.
+func lookupRootfsGroupID(gid string) (*user.Group, error) {
+	groups, err := readGroupFile(rootfsFilePath("etc/group"))
+	if err == nil {
+		for _, g := range groups {
+			if g.Gid == gid {
+				return &g.Group, nil
+			}
+		}
+	}
+	return user.LookupGroupId(gid)
+}
+
+// lookupRootfsGroupIDs returns the GIDs of u from the group file of the rootfs, falling back to NSS.
+func lookupRootfsGroupIDs(u *user.User) ([]string, error) {
+	groups, err := readGroupFile(rootfsFilePath("etc/group"))
+	if err != nil {
+		return u.GroupIds()
+	}
+	gids := []string{u.Gid}
+	var member bool
+	for _, g := range groups {
+		if !slices.Contains(g.members, u.Username) {
+			continue
+		}
+		member = true
+		if !slices.Contains(gids, g.Gid) {
+			gids = append(gids, g.Gid)
+		}
+	}
+	if !member {
+		return u.GroupIds()
+	}
+	return gids, nil
+}
+
+type groupFileEntry struct {
+	user.Group
+	members []string
+}
+
+// readGroupFile returns the groups of a group file.
+func readGroupFile(path string) ([]groupFileEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var groups []groupFileEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			continue
+		}
+		g := groupFileEntry{Group: user.Group{Name: fields[0], Gid: fields[2]}}
+		if fields[3] != "" {
+			g.members = strings.Split(fields[3], ",")
+		}
+		groups = append(groups, g)
+	}
+	return groups, scanner.Err()
+}
+
+// getHidepid returns the hidepid mode and gid of the procfs mounted at path read from mountinfo.
+func getHidepid(mountinfo string, path string) (float64, string, error) {
+	f, err := os.Open(mountinfo)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	path = filepath.Clean(path)
+	var mode float64
+	var gid string
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 25 30 0:23 / /proc rw,nosuid,nodev,noexec,relatime shared:13 - proc proc rw,hidepid=invisible,gid=1000
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(pre)
+		superFields := strings.Fields(post)
+		if len(fields) < 6 || len(superFields) < 3 || fields[4] != path || superFields[0] != "proc" {
+			continue
+		}
+		// The last mount at path is the one that is visible
+		found = true
+		mode, gid = 0, ""
+		for _, option := range strings.Split(fields[5]+","+superFields[2], ",") {
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "hidepid":
+				m, ok := hidepidModes[value]
+				if !ok {
+					return 0, "", fmt.Errorf("unknown hidepid mode %q", value)
+				}
+				mode = m
+			case "gid":
+				gid = value
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, "", err
+	}
+	if found {
+		return mode, gid, nil
+	}
+	return 0, "", fmt.Errorf("no procfs mounted at %s", path)
+}
@@ -0,0 +1,227 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+const testMountinfo = `22 1 259:1 / / rw,relatime shared:1 - xfs /dev/nvme0n1p1 rw,attr2,inode64
+25 22 0:23 / /proc rw,nosuid,nodev,noexec,relatime shared:13 - proc proc rw
+26 22 0:24 / /sys rw,nosuid,nodev,noexec,relatime shared:2 - sysfs sysfs rw
+30 22 0:27 / /host/proc rw,nosuid,nodev,noexec,relatime shared:20 - proc proc rw,hidepid=2
+31 22 0:28 / /hidden/proc rw,nosuid,nodev,noexec,relatime shared:21 - proc proc rw,hidepid=invisible,gid=1001
+32 22 0:29 / /hidden/proc rw,nosuid,nodev,noexec,relatime shared:22 - proc proc rw
+`
+
+func writeTestFile(t *testing.T, name string, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGetHidepid(t *testing.T) {
+	mountinfo := writeTestFile(t, "mountinfo", testMountinfo)
+	tests := []struct {
+		path string
+		mode float64
+		gid  string
+	}{
+		{path: "/proc", mode: 0},
+		{path: "/host/proc/", mode: 2},
+		// The proc mounted over the hidepid mount is used
+		{path: "/hidden/proc", mode: 0},
+	}
+	for _, test := range tests {
+		mode, gid, err := getHidepid(mountinfo, test.path)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.path, err.Error())
+			continue
+		}
+		if mode != test.mode || gid != test.gid {
+			t.Errorf("Unexpected hidepid for %s, expected %v %q, got %v %q", test.path, test.mode, test.gid, mode, gid)
+		}
+	}
+	if _, _, err := getHidepid(mountinfo, "/sys"); err == nil {
+		t.Errorf("Expected error for path that is not procfs")
+	}
+	invalid := writeTestFile(t, "mountinfo", "25 22 0:23 / /proc rw shared:13 - proc proc rw,hidepid=foo\n")
+	if _, _, err := getHidepid(invalid, "/proc"); err == nil {
+		t.Errorf("Expected error for unknown hidepid mode")
+	}
+}
+
+func TestGetHidepidGID(t *testing.T) {
+	mountinfo := writeTestFile(t, "mountinfo", "31 22 0:28 / /proc rw,nosuid - proc proc rw,hidepid=invisible,gid=1001\n")
+	mode, gid, err := getHidepid(mountinfo, "/proc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if mode != 2 || gid != "1001" {
+		t.Errorf("Unexpected hidepid, expected 2 \"1001\", got %v %q", mode, gid)
+	}
+}
+
+func TestIdentityUIDMap(t *testing.T) {
+	logger := promslog.NewNopLogger()
+	if !identityUIDMap(writeTestFile(t, "uid_map", "         0          0 4294967295\n"), logger) {
+		t.Errorf("Expected identity uid_map")
+	}
+	if identityUIDMap(writeTestFile(t, "uid_map", "         0     100000      65536\n"), logger) {
+		t.Errorf("Expected user namespace uid_map")
+	}
+	if !identityUIDMap(filepath.Join(t.TempDir(), "missing"), logger) {
+		t.Errorf("Expected identity when uid_map is missing")
+	}
+}
+
+func TestLookupRootfsUser(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "# comment\nroot:x:0:0:root:/root:/bin/bash\nmsqueo:x:32666:32666:Mike:/home/msqueo:/bin/bash\n"
+	if err := os.WriteFile(filepath.Join(rootfs, "etc/passwd"), []byte(passwd), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootFS = rootfs
+	defer func() { rootFS = "/" }()
+	u, err := lookupRootfsUserID("32666")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if u.Username != "msqueo" || u.HomeDir != "/home/msqueo" {
+		t.Errorf("Unexpected user %v", u)
+	}
+	u, err = lookupRootfsUser("msqueo")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if u.Uid != "32666" {
+		t.Errorf("Unexpected UID %s", u.Uid)
+	}
+	// Users not in the passwd file of the rootfs fall back to NSS
+	if _, err := lookupRootfsUserID("4294967294"); err == nil {
+		t.Errorf("Expected error for unknown UID")
+	}
+}
+
+func TestLookupRootfsGroup(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	group := "# comment\nroot:x:0:\nPZS0002:x:32666:\nPZS0708:x:5509:msqueo,tdockendorf\nwheel:x:10:tdockendorf\n"
+	if err := os.WriteFile(filepath.Join(rootfs, "etc/group"), []byte(group), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootFS = rootfs
+	defer func() { rootFS = "/" }()
+	g, err := lookupRootfsGroupID("32666")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if g.Name != "PZS0002" {
+		t.Errorf("Unexpected group %v", g)
+	}
+	gids, err := lookupRootfsGroupIDs(&user.User{Uid: "32666", Gid: "32666", Username: "msqueo"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !reflect.DeepEqual(gids, []string{"32666", "5509"}) {
+		t.Errorf("Unexpected GIDs %v", gids)
+	}
+	// Groups not in the group file of the rootfs fall back to NSS
+	if _, err := lookupRootfsGroupID("4294967294"); err == nil {
+		t.Errorf("Expected error for unknown GID")
+	}
+}
+
+func TestConfigurePaths(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--path.procfs=/host/proc", "--path.sysfs=/host/sys", "--path.rootfs=/host"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _ = kingpin.CommandLine.Parse([]string{})
+		procFS = "/proc"
+		cgroupFS = "/sys/fs/cgroup"
+		rootFS = "/"
+		oodPortalPath = "/etc/ood/config/ood_portal.yml"
+		nginxStageConfigPath = "/etc/ood/config/nginx_stage.yml"
+		passengerRegistryPath = "/var/run/ondemand-passenger"
+		lookupUserID = user.LookupId
+		lookupUser = user.Lookup
+		lookupGroupID = user.LookupGroupId
+		lookupGroupIDs = (*user.User).GroupIds
+	}()
+	ConfigurePaths(promslog.NewNopLogger())
+	if procFS != "/host/proc" {
+		t.Errorf("Unexpected procfs %s", procFS)
+	}
+	if cgroupFS != "/host/sys/fs/cgroup" {
+		t.Errorf("Unexpected cgroupfs %s", cgroupFS)
+	}
+	if oodPortalPath != "/host/etc/ood/config/ood_portal.yml" {
+		t.Errorf("Unexpected ood_portal.yml path %s", oodPortalPath)
+	}
+	if passengerRegistryPath != "/host/var/run/ondemand-passenger" {
+		t.Errorf("Unexpected Passenger instance registry path %s", passengerRegistryPath)
+	}
+}
+
+func TestCollectProcfsVisibility(t *testing.T) {
+	snapshot := getTestSnapshot(t)
+	mountinfoPath = writeTestFile(t, "mountinfo", "30 22 0:27 / "+procFS+" rw,nosuid - proc proc rw,hidepid=2\n")
+	defer func() { mountinfoPath = "/proc/self/mountinfo" }()
+	expected := `
+		# HELP ondemand_exporter_procfs_hidepid The hidepid mode procfs is mounted with, 0 when processes of other users are visible
+		# TYPE ondemand_exporter_procfs_hidepid gauge
+		ondemand_exporter_procfs_hidepid{gid=""} 2
+		# HELP ondemand_exporter_puns_not_visible Number of active PUNs without any process visible in procfs
+		# TYPE ondemand_exporter_puns_not_visible gauge
+		ondemand_exporter_puns_not_visible 1
+	`
+	collector := NewCollector(promslog.NewNopLogger())
+	c := funcCollector(func(ch chan<- prometheus.Metric) {
+		collector.collectProcfsVisibility(snapshot, []string{"32666", "20821", "99999"}, ch)
+	})
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_exporter_procfs_hidepid", "ondemand_exporter_puns_not_visible"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	snapshot.Partial = true
+	if n := testutil.CollectAndCount(c, "ondemand_exporter_puns_not_visible"); n != 0 {
+		t.Errorf("Unexpected PUNs not visible for partial snapshot: %d", n)
+	}
+}
@@ -23,10 +23,17 @@
 package collectors
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
+	"math"
+	"net/url"
+	"regexp"
 	"slices"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
@@ -34,9 +41,38 @@ import (
 	"github.com/prometheus/procfs"
 )
 
+const (
+	processKindOther = "other"
+	shellHostUnknown = "unknown"
+	// ssh options that take an argument, see ssh(1)
+	sshOptionsWithArgs = "BbcDEeFIiJLlmOopQRSWw"
+)
+
 var (
-	processTimeout = kingpin.Flag("collector.process.timeout", "Timeout for process collection").Default("10").Envar("PROCESS_TIMEOUT").Int()
-	procFS         = "/proc"
+	processTimeout         = kingpin.Flag("collector.process.timeout", "Timeout for process collection").Default("10").Envar("PROCESS_TIMEOUT").Int()
+	processDStateThreshold = kingpin.Flag("collector.process.d-state-threshold", "Duration a PUN process must be in uninterruptible sleep to count the PUN as hung").Default("2m").Envar("PROCESS_D_STATE_THRESHOLD").Duration()
+	processSmaps           = kingpin.Flag("collector.process.smaps", "Read PSS, USS and swap of PUN processes from smaps_rollup").Default("false").Envar("PROCESS_SMAPS").Bool()
+	processPerUser         = kingpin.Flag("collector.process.per-user", "Report open file descriptors, I/O and threads of every PUN with a user label").Default("false").Envar("PROCESS_PER_USER").Bool()
+	processKinds           = kingpin.Flag("collector.process.kind", "Kind of PUN process as kind=regex matched against the process cmdline, may be repeated and is checked before the default kinds").PlaceHolder("KIND=REGEX").Envar("PROCESS_KIND").Strings()
+	procFS                 = "/proc"
+	// Ordered default kinds of PUN processes, the first match is used
+	defaultProcessKinds = []string{
+		`rack=rack-loader\.rb`,
+		`node=Passenger NodeApp`,
+		`python=wsgi-loader\.py|^Passenger (Python|Wsgi)App`,
+		`passenger_watchdog=^Passenger watchdog`,
+		`passenger_core=^Passenger core`,
+		`passenger_preloader=^Passenger (AppPreloader|spawn)`,
+		`nginx=^nginx: `,
+		`shell=(^|/)ssh( |$)`,
+		`file_transfer=(^|/)(rsync|scp|sftp|cp|mv|rm|zip|unzip)( |$)`,
+		`git=(^|/)git(-[a-z-]+)?( |$)`,
+	}
+	// Scheduler states of PUN processes that are reported
+	processStates          = []string{"R", "S", "D", "Z", "T"}
+	processStateTracker    = newProcessDStateTracker()
+	processIOTracker       = newProcessIOCounterTracker()
+	shellSessionAgeBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400, 259200, 604800}
 )
 
 type ProcessCollector struct {
@@ -45,6 +81,30 @@ type ProcessCollector struct {
 	PunCpuTime       *prometheus.Desc
 	PunMemory        *prometheus.Desc
 	PunMemoryPercent *prometheus.Desc
+	KindProcesses    *prometheus.Desc
+	KindCpuTime      *prometheus.Desc
+	KindMemory       *prometheus.Desc
+	ShellSessions    *prometheus.Desc
+	ShellSessionAge  *prometheus.Desc
+	ProcessStates    *prometheus.Desc
+	Threads          *prometheus.Desc
+	HungPuns         *prometheus.Desc
+	UserMemory       *prometheus.Desc
+	SmapsMissing     *prometheus.Desc
+	OpenFDs          *prometheus.Desc
+	FDUtilization    *prometheus.Desc
+	ReadBytes        *prometheus.Desc
+	WriteBytes       *prometheus.Desc
+	UserOpenFDs      *prometheus.Desc
+	UserFDUtil       *prometheus.Desc
+	UserReadBytes    *prometheus.Desc
+	UserWriteBytes   *prometheus.Desc
+	UserThreads      *prometheus.Desc
+	HostMemory       *prometheus.Desc
+	Pressure         *prometheus.Desc
+	PressureStalled  *prometheus.Desc
+	MemoryAverage    *prometheus.Desc
+	Capacity         *prometheus.Desc
 	logger           *slog.Logger
 }
 
@@ -55,40 +115,324 @@ type ProcessMetrics struct {
 	PunMemoryRSS     float64
 	PunMemoryVMS     float64
 	PunMemoryPercent float64
+	Kinds            map[string]ProcessKindMetrics
+	ShellSessions    map[string]Histogram
+	States           map[string]float64
+	Threads          float64
+	HungPuns         float64
+	Partial          bool
+	Smaps            bool
+	PunMemoryPSS     float64
+	PunMemoryUSS     float64
+	PunMemorySwap    float64
+	SmapsMissing     float64
+	OpenFDs          float64
+	FDUtilization    float64
+	ReadBytes        float64
+	WriteBytes       float64
+	Users            map[string]ProcessUserMetrics
+	Host             HostMetrics
+	PunMemoryAverage float64
+	PunCapacity      float64
+}
+
+// ProcessUserMetrics are the metrics of the processes of a PUN.
+// Memory is read from smaps_rollup, FDUtilization is the highest ratio of
+// open file descriptors to the soft limit of any process of the PUN.
+type ProcessUserMetrics struct {
+	MemoryPSS     float64
+	MemoryUSS     float64
+	MemorySwap    float64
+	OpenFDs       float64
+	FDUtilization float64
+	ReadBytes     float64
+	WriteBytes    float64
+	Threads       float64
+}
+
+type ProcessKindMetrics struct {
+	Processes float64
+	CpuTime   float64
+	MemoryRSS float64
+	MemoryVMS float64
+}
+
+type punProcess struct {
+	pid       int
+	uid       string
+	starttime uint64
+}
+
+// processDStateTracker remembers when PUN processes were first seen in uninterruptible sleep.
+type processDStateTracker struct {
+	sync.Mutex
+	since map[punProcess]time.Time
+}
+
+func newProcessDStateTracker() *processDStateTracker {
+	return &processDStateTracker{
+		since: make(map[punProcess]time.Time),
+	}
+}
+
+// update records the processes currently in D state and returns the number of
+// PUNs with a process that has been in D state for at least threshold.
+// Processes are keyed by start time as well as PID to handle PID reuse.
+// For partial results processes that were not seen are kept rather than forgotten.
+func (t *processDStateTracker) update(procs []punProcess, now time.Time, threshold time.Duration, partial bool) int {
+	t.Lock()
+	defer t.Unlock()
+	since := make(map[punProcess]time.Time)
+	if partial {
+		maps.Copy(since, t.since)
+	}
+	for _, p := range procs {
+		s, ok := t.since[p]
+		if !ok {
+			s = now
+		}
+		since[p] = s
+	}
+	hung := make(map[string]struct{})
+	for p, s := range since {
+		if now.Sub(s) >= threshold {
+			hung[p.uid] = struct{}{}
+		}
+	}
+	t.since = since
+	return len(hung)
+}
+
+// processIO is the storage I/O of a process or the total of processes.
+type processIO struct {
+	read  uint64
+	write uint64
+}
+
+func (i *processIO) add(o processIO) {
+	i.read += o.read
+	i.write += o.write
+}
+
+// processIOCounterTracker remembers the I/O of PUN processes so the I/O of a PUN remains monotonic as its processes exit.
+type processIOCounterTracker struct {
+	sync.Mutex
+	processes map[punProcess]processIO
+	parents   map[punProcess]int
+	exited    map[string]processIO
+	// I/O of exited processes of UIDs that are no longer PUNs
+	gone processIO
+}
+
+func newProcessIOCounterTracker() *processIOCounterTracker {
+	return &processIOCounterTracker{
+		processes: make(map[punProcess]processIO),
+		parents:   make(map[punProcess]int),
+		exited:    make(map[string]processIO),
+	}
 }
 
-func getProcessMetrics(puns []string, logger *slog.Logger) (ProcessMetrics, error) {
+// update records the I/O read for PUN processes and returns the I/O of every PUN
+// and the total including PUNs that have since stopped.
+// parents are the parent PIDs of procs. When a process is reaped the kernel adds its I/O to
+// its parent, so the I/O of exited processes is only kept if their parent is not a PUN process.
+// Processes in procs whose I/O could not be read keep their previous values.
+// For partial results processes that were not seen are kept rather than counted as exited.
+func (t *processIOCounterTracker) update(procs []punProcess, parents map[punProcess]int, io map[punProcess]processIO, puns []string, partial bool) (map[string]processIO, processIO) {
+	t.Lock()
+	defer t.Unlock()
+	processes := make(map[punProcess]processIO)
+	pids := make(map[int]struct{})
+	for _, p := range procs {
+		if i, ok := io[p]; ok {
+			processes[p] = i
+		} else if i, ok := t.processes[p]; ok {
+			processes[p] = i
+		}
+		pids[p.pid] = struct{}{}
+	}
+	for p, i := range t.processes {
+		if _, ok := processes[p]; ok {
+			continue
+		}
+		if partial {
+			processes[p] = i
+			continue
+		}
+		if _, ok := pids[t.parents[p]]; ok {
+			continue
+		}
+		exited := t.exited[p.uid]
+		exited.add(i)
+		t.exited[p.uid] = exited
+	}
+	newParents := make(map[punProcess]int)
+	for p := range processes {
+		if ppid, ok := parents[p]; ok {
+			newParents[p] = ppid
+		} else if ppid, ok := t.parents[p]; ok {
+			newParents[p] = ppid
+		}
+	}
+	t.parents = newParents
+	t.processes = processes
+	for uid, i := range t.exited {
+		if !slices.Contains(puns, uid) && !partial {
+			t.gone.add(i)
+			delete(t.exited, uid)
+		}
+	}
+	users := make(map[string]processIO)
+	total := t.gone
+	for uid, i := range t.exited {
+		users[uid] = i
+		total.add(i)
+	}
+	for p, i := range processes {
+		u := users[p.uid]
+		u.add(i)
+		users[p.uid] = u
+		total.add(i)
+	}
+	return users, total
+}
+
+type shellSession struct {
+	ppid  int
+	host  string
+	start float64
+}
+
+type processKind struct {
+	kind    string
+	pattern *regexp.Regexp
+}
+
+// getProcessKinds returns the configured process kinds followed by the defaults.
+func getProcessKinds() ([]processKind, error) {
+	var kinds []processKind
+	for _, k := range append(slices.Clone(*processKinds), defaultProcessKinds...) {
+		kind, pattern, ok := strings.Cut(k, "=")
+		if !ok || kind == "" || pattern == "" {
+			return nil, fmt.Errorf("invalid process kind %q, expected kind=regex", k)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid process kind %s regex: %w", kind, err)
+		}
+		kinds = append(kinds, processKind{kind: kind, pattern: re})
+	}
+	return kinds, nil
+}
+
+// classifyProcess returns the kind of the first pattern matching the cmdline,
+// or the comm name for processes without a cmdline.
+func classifyProcess(kinds []processKind, cmdline string, comm string) string {
+	if cmdline == "" {
+		cmdline = comm
+	}
+	for _, k := range kinds {
+		if k.pattern.MatchString(cmdline) {
+			return k.kind
+		}
+	}
+	return processKindOther
+}
+
+// parseSSHHost returns the destination host from the arguments of an ssh command.
+func parseSSHHost(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return sshDestinationHost(args[i+1])
+			}
+			return ""
+		}
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			for j := 1; j < len(arg); j++ {
+				if strings.IndexByte(sshOptionsWithArgs, arg[j]) >= 0 {
+					// The argument is the next arg unless attached, eg -lfoo
+					if j == len(arg)-1 {
+						i++
+					}
+					break
+				}
+			}
+			continue
+		}
+		return sshDestinationHost(arg)
+	}
+	return ""
+}
+
+// sshDestinationHost returns the host of an ssh destination of the form
+// [user@]host or ssh://[user@]host[:port].
+func sshDestinationHost(destination string) string {
+	if strings.HasPrefix(destination, "ssh://") {
+		u, err := url.Parse(destination)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	if i := strings.LastIndex(destination, "@"); i >= 0 {
+		destination = destination[i+1:]
+	}
+	return destination
+}
+
+// getProcessMetrics reads metrics of PUN processes from the snapshot.
+// Cancellation is checked between processes, when the context is done the metrics
+// of the processes read so far are returned as partial results with the context error.
+func getProcessMetrics(ctx context.Context, snapshot *ProcessSnapshot, puns []string, logger *slog.Logger) (ProcessMetrics, error) {
 	var metrics ProcessMetrics
 	var rackApps, nodeApps float64
 	var pun_cpu_time float64
 	var pun_memory_rss, pun_memory_vms float64
-	procfs, err := procfs.NewFS(procFS)
+	kinds, err := getProcessKinds()
 	if err != nil {
 		return ProcessMetrics{}, err
 	}
-	meminfo, err := procfs.Meminfo()
+	kindMetrics := make(map[string]ProcessKindMetrics)
+	for _, k := range kinds {
+		kindMetrics[k.kind] = ProcessKindMetrics{}
+	}
+	kindMetrics[processKindOther] = ProcessKindMetrics{}
+	punPIDs := make(map[int]struct{})
+	var shellSessions []shellSession
+	sshPIDs := make(map[int]struct{})
+	var dStateProcs []punProcess
+	states := make(map[string]float64)
+	for _, state := range processStates {
+		states[state] = 0
+	}
+	var threads float64
+	users := make(map[string]ProcessUserMetrics)
+	var punProcs []punProcess
+	punParents := make(map[punProcess]int)
+	procIO := make(map[punProcess]processIO)
+	if snapshot == nil {
+		return ProcessMetrics{}, errors.New("no procfs snapshot")
+	}
+	fs, err := procfs.NewFS(procFS)
 	if err != nil {
 		return ProcessMetrics{}, err
 	}
-	procs, err := procfs.AllProcs()
+	meminfo, err := fs.Meminfo()
 	if err != nil {
 		return ProcessMetrics{}, err
 	}
 	logger.Debug("Getting process for PUNS", "puns", strings.Join(puns, ","))
-	for _, proc := range procs {
-		procCmdLine, _ := proc.CmdLine()
-		cmdline := strings.Join(procCmdLine, " ")
-		status, err := proc.NewStatus()
-		if err != nil {
-			logger.Debug("Unable to get process status", "pid", proc.PID, "cmdline", cmdline)
-			continue
-		}
-		uid := strconv.FormatUint(status.UIDs[0], 10)
-		stat, err := proc.Stat()
-		if err != nil {
-			logger.Debug("Unable to get PUN proc stat", "pid", proc.PID, "uid", uid, "cmdline", cmdline)
-			continue
+	metrics.Partial = snapshot.Partial
+	for _, proc := range snapshot.Procs {
+		if ctx.Err() != nil {
+			metrics.Partial = true
+			break
 		}
+		cmdline := strings.Join(proc.Cmdline, " ")
+		uid := proc.UID
+		stat := proc.Stat
 		if uid == "0" {
 			continue
 		}
@@ -96,24 +440,143 @@ func getProcessMetrics(puns []string, logger *slog.Logger) (ProcessMetrics, erro
 			logger.Debug("Skip PID that does not belong to PUN", "pid", proc.PID, "uid", uid, "cmdline", cmdline)
 			continue
 		}
-		if strings.Contains(cmdline, "rack-loader.rb") {
+		punPIDs[proc.PID] = struct{}{}
+		state := stat.State
+		if state == "t" {
+			state = "T"
+		}
+		if _, ok := states[state]; ok {
+			states[state]++
+		}
+		if state == "D" {
+			dStateProcs = append(dStateProcs, punProcess{pid: proc.PID, uid: uid, starttime: stat.Starttime})
+		}
+		threads = threads + float64(stat.NumThreads)
+		p := punProcess{pid: proc.PID, uid: uid, starttime: stat.Starttime}
+		punProcs = append(punProcs, p)
+		punParents[p] = proc.PPID
+		u := users[uid]
+		u.Threads = u.Threads + float64(stat.NumThreads)
+		// The fd, limits and io of processes of other users can only be read as root
+		if fds, err := proc.FileDescriptorsLen(); err != nil {
+			logger.Debug("Unable to get PUN process file descriptors", "pid", proc.PID, "uid", uid, "err", err)
+		} else {
+			u.OpenFDs = u.OpenFDs + float64(fds)
+			limits, err := proc.Limits()
+			if err != nil {
+				logger.Debug("Unable to get PUN process limits", "pid", proc.PID, "uid", uid, "err", err)
+			} else if limits.OpenFiles > 0 && limits.OpenFiles != math.MaxUint64 {
+				u.FDUtilization = max(u.FDUtilization, float64(fds)/float64(limits.OpenFiles))
+			}
+		}
+		if io, err := proc.IO(); err != nil {
+			logger.Debug("Unable to get PUN process I/O", "pid", proc.PID, "uid", uid, "err", err)
+		} else {
+			procIO[p] = processIO{read: io.ReadBytes, write: io.WriteBytes}
+		}
+		users[uid] = u
+		if stat.Comm == "ssh" {
+			sshPIDs[proc.PID] = struct{}{}
+		}
+		if stat.Comm == "ssh" && len(proc.Cmdline) > 0 {
+			session := shellSession{ppid: proc.PPID, host: parseSSHHost(proc.Cmdline[1:]), start: proc.StartTime}
+			if session.host == "" {
+				session.host = shellHostUnknown
+			}
+			shellSessions = append(shellSessions, session)
+		}
+		kind := classifyProcess(kinds, cmdline, stat.Comm)
+		switch kind {
+		case "rack":
 			rackApps++
-		} else if strings.Contains(cmdline, "Passenger NodeApp") {
+		case "node":
 			nodeApps++
 		}
-		logger.Debug("Collecting PUN proc stat", "pid", proc.PID, "uid", uid,
+		km := kindMetrics[kind]
+		km.Processes++
+		km.CpuTime = km.CpuTime + stat.CPUTime()
+		km.MemoryRSS = km.MemoryRSS + float64(stat.ResidentMemory())
+		km.MemoryVMS = km.MemoryVMS + float64(stat.VirtualMemory())
+		kindMetrics[kind] = km
+		logger.Debug("Collecting PUN proc stat", "pid", proc.PID, "uid", uid, "kind", kind,
 			"cputime", stat.CPUTime(), "rss", stat.ResidentMemory(), "vms", stat.VirtualMemory())
 		pun_cpu_time = pun_cpu_time + stat.CPUTime()
 		pun_memory_rss = pun_memory_rss + float64(stat.ResidentMemory())
 		pun_memory_vms = pun_memory_vms + float64(stat.VirtualMemory())
+		if *processSmaps {
+			smaps, err := proc.ProcSMapsRollup()
+			if err != nil {
+				// The process may have exited since the snapshot was taken
+				logger.Debug("Unable to get PUN process smaps_rollup", "pid", proc.PID, "uid", uid, "err", err)
+				metrics.SmapsMissing++
+			} else {
+				u := users[uid]
+				u.MemoryPSS = u.MemoryPSS + float64(smaps.Pss)
+				u.MemoryUSS = u.MemoryUSS + float64(smaps.PrivateClean+smaps.PrivateDirty)
+				u.MemorySwap = u.MemorySwap + float64(smaps.Swap)
+				users[uid] = u
+			}
+		}
 	}
 	metrics.RackApps = rackApps
 	metrics.NodeApps = nodeApps
 	metrics.PunCpuTime = pun_cpu_time
 	metrics.PunMemoryRSS = pun_memory_rss
 	metrics.PunMemoryVMS = pun_memory_vms
+	metrics.Kinds = kindMetrics
+	metrics.States = states
+	metrics.Threads = threads
+	metrics.HungPuns = float64(processStateTracker.update(dStateProcs, timeNow(), *processDStateThreshold, metrics.Partial))
+	metrics.ShellSessions = make(map[string]Histogram)
+	now := float64(timeNow().Unix())
+	for _, session := range shellSessions {
+		// Only ssh started by the PUN, such as by the Shell app, is a shell session
+		if _, ok := punPIDs[session.ppid]; !ok {
+			continue
+		}
+		// ssh started by ssh, such as for ProxyJump, is part of the session of its parent
+		if _, ok := sshPIDs[session.ppid]; ok {
+			continue
+		}
+		h, ok := metrics.ShellSessions[session.host]
+		if !ok {
+			h = newHistogram(shellSessionAgeBuckets)
+		}
+		h.observe(max(now-session.start, 0))
+		metrics.ShellSessions[session.host] = h
+	}
 	metrics.PunMemoryPercent = 100 * (float64(pun_memory_rss) / (float64(*meminfo.MemTotal) * 1024.0))
-	return metrics, nil
+	userIO, totalIO := processIOTracker.update(punProcs, punParents, procIO, puns, metrics.Partial)
+	metrics.ReadBytes = float64(totalIO.read)
+	metrics.WriteBytes = float64(totalIO.write)
+	metrics.Smaps = *processSmaps
+	if *processSmaps || *processPerUser {
+		metrics.Users = make(map[string]ProcessUserMetrics)
+	}
+	for uid, u := range users {
+		metrics.OpenFDs = metrics.OpenFDs + u.OpenFDs
+		metrics.FDUtilization = max(metrics.FDUtilization, u.FDUtilization)
+		metrics.PunMemoryPSS = metrics.PunMemoryPSS + u.MemoryPSS
+		metrics.PunMemoryUSS = metrics.PunMemoryUSS + u.MemoryUSS
+		metrics.PunMemorySwap = metrics.PunMemorySwap + u.MemorySwap
+		u.ReadBytes = float64(userIO[uid].read)
+		u.WriteBytes = float64(userIO[uid].write)
+		if metrics.Users != nil {
+			metrics.Users[userLabel(getUsername(uid, logger))] = u
+		}
+	}
+	punMemory := pun_memory_rss
+	if *processSmaps {
+		// PSS does not count shared libraries more than once
+		metrics.PunMemoryPercent = 100 * (metrics.PunMemoryPSS / (float64(*meminfo.MemTotal) * 1024.0))
+		punMemory = metrics.PunMemoryPSS
+	}
+	metrics.Host = getHostMetrics(fs, meminfo, logger)
+	if len(users) > 0 {
+		metrics.PunMemoryAverage = punMemory / float64(len(users))
+		metrics.PunCapacity = punCapacity(metrics.Host, metrics.PunMemoryAverage, *hostMemoryReserve)
+	}
+	return metrics, ctx.Err()
 }
 
 func NewProcessCollector(logger *slog.Logger) *ProcessCollector {
@@ -124,36 +587,58 @@ func NewProcessCollector(logger *slog.Logger) *ProcessCollector {
 		PunCpuTime:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pun_cpu_time"), "CPU time of all PUNs", nil, nil),
 		PunMemory:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pun_memory"), "Memory used by all PUNs", []string{"type"}, nil),
 		PunMemoryPercent: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pun_memory_percent"), "Percent memory of all PUNs", nil, nil),
+		KindProcesses:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "processes"), "Number of PUN processes by kind", []string{"kind"}, nil),
+		KindCpuTime:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "cpu_seconds"), "CPU time in seconds of PUN processes by kind", []string{"kind"}, nil),
+		KindMemory:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "memory_bytes"), "Memory used by PUN processes by kind", []string{"kind", "type"}, nil),
+		ShellSessions:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "shell", "sessions"), "Number of ssh sessions started by PUNs", []string{"host"}, nil),
+		ShellSessionAge:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "shell", "session_age_seconds"), "Age of ssh sessions started by PUNs", []string{"host"}, nil),
+		ProcessStates:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "process_states"), "Number of PUN processes by scheduler state", []string{"state"}, nil),
+		Threads:          prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "threads"), "Number of threads of all PUN processes", nil, nil),
+		UserMemory:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user", "memory_bytes"), "Memory used by the processes of a PUN", []string{"user", "type"}, nil),
+		SmapsMissing:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "smaps_missing_processes"), "Number of PUN processes whose smaps_rollup could not be read", nil, nil),
+		HungPuns:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "hung_puns"), "Number of PUNs with a process in uninterruptible sleep longer than the threshold", nil, nil),
+		OpenFDs:          prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "open_fds"), "Number of open file descriptors of all PUN processes", nil, nil),
+		FDUtilization:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "fd_utilization_ratio"), "Highest ratio of open file descriptors to the soft limit of any PUN process", nil, nil),
+		ReadBytes:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "read_bytes_total"), "Bytes read from storage by PUN processes", nil, nil),
+		WriteBytes:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "write_bytes_total"), "Bytes written to storage by PUN processes", nil, nil),
+		UserOpenFDs:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user", "open_fds"), "Number of open file descriptors of the processes of a PUN", []string{"user"}, nil),
+		UserFDUtil:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user", "fd_utilization_ratio"), "Highest ratio of open file descriptors to the soft limit of any process of a PUN", []string{"user"}, nil),
+		UserReadBytes:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user", "read_bytes_total"), "Bytes read from storage by the processes of a PUN", []string{"user"}, nil),
+		UserWriteBytes:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user", "write_bytes_total"), "Bytes written to storage by the processes of a PUN", []string{"user"}, nil),
+		UserThreads:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun_user", "threads"), "Number of threads of the processes of a PUN", []string{"user"}, nil),
+		HostMemory:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "host", "memory_bytes"), "Total and available memory of the host", []string{"type"}, nil),
+		Pressure:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "host", "pressure_ratio"), "Ratio of time tasks were stalled on a resource averaged over a window", []string{"resource", "type", "window"}, nil),
+		PressureStalled:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "host", "pressure_stalled_seconds_total"), "Time tasks were stalled on a resource", []string{"resource", "type"}, nil),
+		MemoryAverage:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "memory_average_bytes"), "Average memory used by a PUN", nil, nil),
+		Capacity:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "pun", "capacity_remaining"), "Estimated number of additional PUNs that fit in available memory", nil, nil),
 	}
 }
 
-func (c *ProcessCollector) collect(puns []string, ch chan<- prometheus.Metric) error {
+func (c *ProcessCollector) collect(snapshot *ProcessSnapshot, puns []string, ch chan<- prometheus.Metric) error {
 	c.logger.Debug("Collecting process metrics")
 	collectTime := time.Now()
 
-	c1 := make(chan int, 1)
-	timeout := false
-	var processMetrics ProcessMetrics
-	var err error
-	go func() {
-		processMetrics, err = getProcessMetrics(puns, c.logger)
-		if !timeout {
-			c1 <- 1
-		}
-	}()
-	select {
-	case <-c1:
-	case <-time.After(time.Duration(*processTimeout) * time.Second):
-		timeout = true
-		close(c1)
+	// Reading the snapshot and collecting process metrics share one deadline
+	deadline := time.Now().Add(time.Duration(*processTimeout) * time.Second)
+	if snapshot != nil && !snapshot.Deadline.IsZero() {
+		deadline = snapshot.Deadline
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	processMetrics, err := getProcessMetrics(ctx, snapshot, puns, c.logger)
+	if errors.Is(err, context.DeadlineExceeded) {
 		ch <- prometheus.MustNewConstMetric(collecTimeout, prometheus.GaugeValue, 1, "process")
-		c.logger.Error("Timeout collecting process information")
-		return nil
+		c.logger.Error("Timeout collecting process information, returning partial results")
+	} else {
+		ch <- prometheus.MustNewConstMetric(collecTimeout, prometheus.GaugeValue, 0, "process")
+		if err != nil {
+			return err
+		}
 	}
-	close(c1)
-	ch <- prometheus.MustNewConstMetric(collecTimeout, prometheus.GaugeValue, 0, "process")
-	if err != nil {
-		return err
+	if processMetrics.Partial {
+		ch <- prometheus.MustNewConstMetric(collectPartial, prometheus.GaugeValue, 1, "process")
+	} else {
+		ch <- prometheus.MustNewConstMetric(collectPartial, prometheus.GaugeValue, 0, "process")
 	}
 	ch <- prometheus.MustNewConstMetric(c.RackApps, prometheus.GaugeValue, processMetrics.RackApps)
 	ch <- prometheus.MustNewConstMetric(c.NodeApps, prometheus.GaugeValue, processMetrics.NodeApps)
@@ -161,6 +646,65 @@ func (c *ProcessCollector) collect(puns []string, ch chan<- prometheus.Metric) e
 	ch <- prometheus.MustNewConstMetric(c.PunMemory, prometheus.GaugeValue, processMetrics.PunMemoryRSS, "rss")
 	ch <- prometheus.MustNewConstMetric(c.PunMemory, prometheus.GaugeValue, processMetrics.PunMemoryVMS, "vms")
 	ch <- prometheus.MustNewConstMetric(c.PunMemoryPercent, prometheus.GaugeValue, processMetrics.PunMemoryPercent)
+	if processMetrics.Smaps {
+		ch <- prometheus.MustNewConstMetric(c.PunMemory, prometheus.GaugeValue, processMetrics.PunMemoryPSS, "pss")
+		ch <- prometheus.MustNewConstMetric(c.PunMemory, prometheus.GaugeValue, processMetrics.PunMemoryUSS, "uss")
+		ch <- prometheus.MustNewConstMetric(c.PunMemory, prometheus.GaugeValue, processMetrics.PunMemorySwap, "swap")
+		ch <- prometheus.MustNewConstMetric(c.SmapsMissing, prometheus.GaugeValue, processMetrics.SmapsMissing)
+		for user, u := range processMetrics.Users {
+			ch <- prometheus.MustNewConstMetric(c.UserMemory, prometheus.GaugeValue, u.MemoryPSS, user, "pss")
+			ch <- prometheus.MustNewConstMetric(c.UserMemory, prometheus.GaugeValue, u.MemoryUSS, user, "uss")
+			ch <- prometheus.MustNewConstMetric(c.UserMemory, prometheus.GaugeValue, u.MemorySwap, user, "swap")
+		}
+	}
+	for kind, m := range processMetrics.Kinds {
+		ch <- prometheus.MustNewConstMetric(c.KindProcesses, prometheus.GaugeValue, m.Processes, kind)
+		ch <- prometheus.MustNewConstMetric(c.KindCpuTime, prometheus.GaugeValue, m.CpuTime, kind)
+		ch <- prometheus.MustNewConstMetric(c.KindMemory, prometheus.GaugeValue, m.MemoryRSS, kind, "rss")
+		ch <- prometheus.MustNewConstMetric(c.KindMemory, prometheus.GaugeValue, m.MemoryVMS, kind, "vms")
+	}
+	for state, count := range processMetrics.States {
+		ch <- prometheus.MustNewConstMetric(c.ProcessStates, prometheus.GaugeValue, count, state)
+	}
+	ch <- prometheus.MustNewConstMetric(c.Threads, prometheus.GaugeValue, processMetrics.Threads)
+	ch <- prometheus.MustNewConstMetric(c.HungPuns, prometheus.GaugeValue, processMetrics.HungPuns)
+	ch <- prometheus.MustNewConstMetric(c.OpenFDs, prometheus.GaugeValue, processMetrics.OpenFDs)
+	ch <- prometheus.MustNewConstMetric(c.FDUtilization, prometheus.GaugeValue, processMetrics.FDUtilization)
+	ch <- prometheus.MustNewConstMetric(c.ReadBytes, prometheus.CounterValue, processMetrics.ReadBytes)
+	ch <- prometheus.MustNewConstMetric(c.WriteBytes, prometheus.CounterValue, processMetrics.WriteBytes)
+	ch <- prometheus.MustNewConstMetric(c.HostMemory, prometheus.GaugeValue, processMetrics.Host.MemoryTotal, "total")
+	ch <- prometheus.MustNewConstMetric(c.HostMemory, prometheus.GaugeValue, processMetrics.Host.MemoryAvailable, "available")
+	for resource, p := range processMetrics.Host.Pressure {
+		c.collectPressure(ch, resource, "some", p.Some)
+		c.collectPressure(ch, resource, "full", p.Full)
+	}
+	if processMetrics.PunMemoryAverage > 0 {
+		ch <- prometheus.MustNewConstMetric(c.MemoryAverage, prometheus.GaugeValue, processMetrics.PunMemoryAverage)
+		ch <- prometheus.MustNewConstMetric(c.Capacity, prometheus.GaugeValue, processMetrics.PunCapacity)
+	}
+	if *processPerUser {
+		for user, u := range processMetrics.Users {
+			ch <- prometheus.MustNewConstMetric(c.UserOpenFDs, prometheus.GaugeValue, u.OpenFDs, user)
+			ch <- prometheus.MustNewConstMetric(c.UserFDUtil, prometheus.GaugeValue, u.FDUtilization, user)
+			ch <- prometheus.MustNewConstMetric(c.UserReadBytes, prometheus.CounterValue, u.ReadBytes, user)
+			ch <- prometheus.MustNewConstMetric(c.UserWriteBytes, prometheus.CounterValue, u.WriteBytes, user)
+			ch <- prometheus.MustNewConstMetric(c.UserThreads, prometheus.GaugeValue, u.Threads, user)
+		}
+	}
+	for host, h := range processMetrics.ShellSessions {
+		ch <- prometheus.MustNewConstMetric(c.ShellSessions, prometheus.GaugeValue, float64(h.Count), host)
+		ch <- prometheus.MustNewConstHistogram(c.ShellSessionAge, h.Count, h.Sum, h.Buckets, host)
+	}
 	ch <- prometheus.MustNewConstMetric(collectDuration, prometheus.GaugeValue, time.Since(collectTime).Seconds(), "process")
 	return nil
 }
+
+func (c *ProcessCollector) collectPressure(ch chan<- prometheus.Metric, resource string, pressureType string, psi *procfs.PSILine) {
+	if psi == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.Pressure, prometheus.GaugeValue, psi.Avg10/100, resource, pressureType, "10s")
+	ch <- prometheus.MustNewConstMetric(c.Pressure, prometheus.GaugeValue, psi.Avg60/100, resource, pressureType, "60s")
+	ch <- prometheus.MustNewConstMetric(c.Pressure, prometheus.GaugeValue, psi.Avg300/100, resource, pressureType, "300s")
+	ch <- prometheus.MustNewConstMetric(c.PressureStalled, prometheus.CounterValue, float64(psi.Total)/1000000, resource, pressureType)
+}
@@ -0,0 +1,181 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/procfs"
+)
+
+const (
+	// USER_HZ used by procfs to report process times
+	userHZ = 100
+)
+
+var (
+	procfsConcurrency = kingpin.Flag("collector.procfs.concurrency", "Number of processes to read from procfs concurrently").Default("8").Envar("PROCFS_CONCURRENCY").Int()
+	readProcess       = readSnapshotProcess
+)
+
+// SnapshotProcess is a process read from procfs for a ProcessSnapshot.
+type SnapshotProcess struct {
+	procfs.Proc
+	PPID      int
+	UID       string
+	Cmdline   []string
+	Stat      procfs.ProcStat
+	StartTime float64
+}
+
+// ProcessSnapshot holds every process read from procfs once per collection.
+type ProcessSnapshot struct {
+	Procs    []*SnapshotProcess
+	Partial  bool
+	Duration time.Duration
+	Deadline time.Time
+	pids     map[int]*SnapshotProcess
+}
+
+// newProcessSnapshot reads all processes from procfs, returning a partial snapshot at the deadline.
+func newProcessSnapshot(ctx context.Context, logger *slog.Logger) (*ProcessSnapshot, error) {
+	start := time.Now()
+	fs, err := procfs.NewFS(procFS)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fs.Stat()
+	if err != nil {
+		return nil, err
+	}
+	procs, err := fs.AllProcs()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &ProcessSnapshot{
+		pids: make(map[int]*SnapshotProcess),
+	}
+	snapshot.Deadline, _ = ctx.Deadline()
+	if len(procs) == 0 {
+		snapshot.Duration = time.Since(start)
+		return snapshot, nil
+	}
+	concurrency := min(max(*procfsConcurrency, 1), len(procs))
+	wg := &sync.WaitGroup{}
+	mutex := &sync.Mutex{}
+	jobs := make(chan procfs.Proc)
+	var results []*SnapshotProcess
+	stopped := false
+	read := readProcess
+	wg.Add(concurrency)
+	for range concurrency {
+		go func() {
+			defer wg.Done()
+			for proc := range jobs {
+				p, err := read(proc, stat.BootTime)
+				if err != nil {
+					logger.Debug("Unable to read process", "pid", proc.PID, "err", err)
+					continue
+				}
+				mutex.Lock()
+				if !stopped {
+					results = append(results, p)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+dispatch:
+	for _, proc := range procs {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case jobs <- proc:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	mutex.Lock()
+	stopped = true
+	snapshot.Procs = results
+	mutex.Unlock()
+	slices.SortFunc(snapshot.Procs, func(a, b *SnapshotProcess) int {
+		return a.PID - b.PID
+	})
+	for _, p := range snapshot.Procs {
+		snapshot.pids[p.PID] = p
+	}
+	snapshot.Duration = time.Since(start)
+	if err := ctx.Err(); err != nil {
+		snapshot.Partial = true
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+func readSnapshotProcess(proc procfs.Proc, bootTime uint64) (*SnapshotProcess, error) {
+	status, err := proc.NewStatus()
+	if err != nil {
+		return nil, err
+	}
+	stat, err := proc.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// cmdline is empty for zombies and kernel threads
+	cmdline, _ := proc.CmdLine()
+	return &SnapshotProcess{
+		Proc:      proc,
+		PPID:      stat.PPID,
+		UID:       strconv.FormatUint(status.UIDs[0], 10),
+		Cmdline:   cmdline,
+		Stat:      stat,
+		StartTime: float64(bootTime) + float64(stat.Starttime)/userHZ,
+	}, nil
+}
+
+// Get returns a process of the snapshot by PID.
+func (s *ProcessSnapshot) Get(pid int) (*SnapshotProcess, bool) {
+	if s == nil {
+		return nil, false
+	}
+	p, ok := s.pids[pid]
+	return p, ok
+}
@@ -0,0 +1,201 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/procfs"
+)
+
+func getTestSnapshot(t testing.TB) *ProcessSnapshot {
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	procFS = filepath.Join(dir, "../fixtures/proc")
+	snapshot, err := newProcessSnapshot(context.Background(), promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	return snapshot
+}
+
+func TestNewProcessSnapshot(t *testing.T) {
+	snapshot := getTestSnapshot(t)
+	if val := len(snapshot.Procs); val != 19 {
+		t.Errorf("Unexpected number of processes, expected 19, got %d", val)
+	}
+	for i := 1; i < len(snapshot.Procs); i++ {
+		if snapshot.Procs[i-1].PID >= snapshot.Procs[i].PID {
+			t.Errorf("Expected processes sorted by PID, got %d before %d", snapshot.Procs[i-1].PID, snapshot.Procs[i].PID)
+		}
+	}
+	if snapshot.Partial {
+		t.Errorf("Expected complete snapshot")
+	}
+	p, ok := snapshot.Get(57625)
+	if !ok {
+		t.Fatalf("Expected PID 57625 in snapshot")
+	}
+	if p.UID != "25056" {
+		t.Errorf("Unexpected UID, expected 25056, got %s", p.UID)
+	}
+	if p.PPID != 57568 {
+		t.Errorf("Unexpected PPID, expected 57568, got %d", p.PPID)
+	}
+	if p.StartTime != 1587044801.5 {
+		t.Errorf("Unexpected StartTime, expected 1587044801.5, got %v", p.StartTime)
+	}
+	if val := p.Stat.CPUTime(); val != 18 {
+		t.Errorf("Unexpected CPU time, expected 18, got %v", val)
+	}
+	p, ok = snapshot.Get(86141)
+	if !ok {
+		t.Fatalf("Expected PID 86141 in snapshot")
+	}
+	if len(p.Cmdline) != 0 || p.Stat.Comm != "git" {
+		t.Errorf("Unexpected zombie process cmdline %v and comm %s", p.Cmdline, p.Stat.Comm)
+	}
+	if _, ok := snapshot.Get(1); ok {
+		t.Errorf("Unexpected PID 1 in snapshot")
+	}
+	var nilSnapshot *ProcessSnapshot
+	if _, ok := nilSnapshot.Get(57625); ok {
+		t.Errorf("Unexpected process from nil snapshot")
+	}
+}
+
+func TestNewProcessSnapshotCancel(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	procFS = filepath.Join(dir, "../fixtures/proc")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	snapshot, err := newProcessSnapshot(ctx, promslog.NewNopLogger())
+	if err == nil {
+		t.Errorf("Expected error")
+	}
+	if snapshot == nil || !snapshot.Partial {
+		t.Fatalf("Expected partial snapshot")
+	}
+	if val := len(snapshot.Procs); val != 0 {
+		t.Errorf("Unexpected number of processes, expected 0, got %d", val)
+	}
+}
+
+func TestNewProcessSnapshotStuck(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	procFS = filepath.Join(dir, "../fixtures/proc")
+	// Reads of process 86140 hang like reads of a process stuck on NFS
+	stuck := make(chan struct{})
+	defer close(stuck)
+	readProcess = func(proc procfs.Proc, bootTime uint64) (*SnapshotProcess, error) {
+		if proc.PID == 86140 {
+			<-stuck
+		}
+		return readSnapshotProcess(proc, bootTime)
+	}
+	defer func() { readProcess = readSnapshotProcess }()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	snapshot, err := newProcessSnapshot(ctx, promslog.NewNopLogger())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Snapshot did not return at the deadline, took %s", elapsed)
+	}
+	if snapshot == nil || !snapshot.Partial {
+		t.Fatalf("Expected partial snapshot")
+	}
+	if _, ok := snapshot.Get(86140); ok {
+		t.Errorf("Unexpected stuck process in snapshot")
+	}
+	if deadline, _ := ctx.Deadline(); !snapshot.Deadline.Equal(deadline) {
+		t.Errorf("Unexpected snapshot deadline %s, expected %s", snapshot.Deadline, deadline)
+	}
+}
+
+func TestNewProcessSnapshotMissing(t *testing.T) {
+	procFS = filepath.Join(t.TempDir(), "proc")
+	if _, err := newProcessSnapshot(context.Background(), promslog.NewNopLogger()); err == nil {
+		t.Errorf("Expected error")
+	}
+}
+
+// writeSyntheticProcFS writes a procfs of count processes for benchmarks
+func writeSyntheticProcFS(b *testing.B, count int) string {
+	dir := filepath.Join(b.TempDir(), "proc")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		b.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte("cpu  1 0 1 1 0 0 0 0 0 0\nbtime 1585250000\n"), 0644); err != nil {
+		b.Fatal(err)
+	}
+	for pid := 1000; pid < 1000+count; pid++ {
+		p := filepath.Join(dir, fmt.Sprintf("%d", pid))
+		if err := os.Mkdir(p, 0755); err != nil {
+			b.Fatal(err)
+		}
+		uid := 20000 + pid%500
+		stat := fmt.Sprintf("%d (ruby) S 1 %d %d 0 -1 4202496 16372 4440 0 0 37 5 1 1 20 0 4 0 179802541 665628672 10139 18446744073709551615 4194304 22495621 140720976269136 140720976253328 140477647847235 0 0 4096 16896 18446744073709551615 0 0 17 0 0 0 0 0 0 34008384 34045952 63971328 140720976273337 140720976273414 140720976273414 140720976277458 0\n", pid, pid, pid)
+		status := fmt.Sprintf("Name:\truby\nState:\tS (sleeping)\nTgid:\t%d\nPid:\t%d\nPPid:\t1\nUid:\t%d\t%d\t%d\t%d\nGid:\t%d\t%d\t%d\t%d\nThreads:\t4\nvoluntary_ctxt_switches:\t10\nnonvoluntary_ctxt_switches:\t1\n", pid, pid, uid, uid, uid, uid, uid, uid, uid, uid)
+		cmdline := "Passenger RubyApp: /var/www/ood/apps/sys/dashboard (production)\x00"
+		for name, content := range map[string]string{"stat": stat, "status": status, "cmdline": cmdline} {
+			if err := os.WriteFile(filepath.Join(p, name), []byte(content), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	return dir
+}
+
+func BenchmarkNewProcessSnapshot(b *testing.B) {
+	procFS = writeSyntheticProcFS(b, 5000)
+	defer func() { _, _ = kingpin.CommandLine.Parse([]string{}) }()
+	logger := promslog.NewNopLogger()
+	for _, concurrency := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			*procfsConcurrency = concurrency
+			for b.Loop() {
+				snapshot, err := newProcessSnapshot(context.Background(), logger)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(snapshot.Procs) != 5000 {
+					b.Fatalf("Unexpected number of processes %d", len(snapshot.Procs))
+				}
+			}
+		})
+	}
+}
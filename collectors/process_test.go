@@ -23,11 +23,21 @@
 package collectors
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os/user"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/common/promslog"
 )
 
@@ -36,7 +46,7 @@ func TestGetProcessMetrics(t *testing.T) {
 	dir := filepath.Dir(filename)
 	procFS = filepath.Join(dir, "../fixtures/proc")
 	logger := promslog.NewNopLogger()
-	m, err := getProcessMetrics([]string{"32666", "20821"}, logger)
+	m, err := getProcessMetrics(context.Background(), getTestSnapshot(t), []string{"32666", "20821"}, logger)
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 		return
@@ -59,4 +69,613 @@ func TestGetProcessMetrics(t *testing.T) {
 	if val := fmt.Sprintf("%.2f", m.PunMemoryPercent); val != "2.04" {
 		t.Errorf("Unexpected value for PunMemoryPercent, expected 2.04, got %v", val)
 	}
+	expectedKinds := map[string]float64{
+		"rack":                4,
+		"node":                1,
+		"python":              0,
+		"passenger_watchdog":  1,
+		"passenger_core":      1,
+		"passenger_preloader": 0,
+		"nginx":               1,
+		"shell":               0,
+		"file_transfer":       0,
+		"git":                 0,
+		"other":               0,
+	}
+	if len(m.Kinds) != len(expectedKinds) {
+		t.Errorf("Unexpected number of kinds, expected %d, got %d", len(expectedKinds), len(m.Kinds))
+	}
+	var rss float64
+	for kind, expected := range expectedKinds {
+		if val := m.Kinds[kind].Processes; val != expected {
+			t.Errorf("Unexpected processes for kind %s, expected %v, got %v", kind, expected, val)
+		}
+		rss = rss + m.Kinds[kind].MemoryRSS
+	}
+	if rss != m.PunMemoryRSS {
+		t.Errorf("Unexpected total RSS of kinds, expected %v, got %v", m.PunMemoryRSS, rss)
+	}
+}
+
+func TestGetProcessMetricsKinds(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.process.kind=dashboard=dashboard", "--collector.process.kind=nginx_worker=^nginx: worker"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		*processKinds = nil
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	procFS = filepath.Join(dir, "../fixtures/proc")
+	m, err := getProcessMetrics(context.Background(), getTestSnapshot(t), []string{"32666", "20821"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if val := m.Kinds["nginx_worker"].Processes; val != 1 {
+		t.Errorf("Unexpected processes for kind nginx_worker, expected 1, got %v", val)
+	}
+	if val := m.Kinds["nginx"].Processes; val != 0 {
+		t.Errorf("Unexpected processes for kind nginx, expected 0, got %v", val)
+	}
+	if val := m.Kinds["dashboard"].Processes + m.Kinds["rack"].Processes; val != 4 {
+		t.Errorf("Unexpected processes for kinds dashboard and rack, expected 4, got %v", val)
+	}
+	if val := m.RackApps; val != m.Kinds["rack"].Processes {
+		t.Errorf("Unexpected value for RackApps, expected %v, got %v", m.Kinds["rack"].Processes, val)
+	}
+}
+
+func TestClassifyProcess(t *testing.T) {
+	kinds, err := getProcessKinds()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	tests := map[string]string{
+		"Passenger RubyApp: /var/www/ood/apps/sys/dashboard (production)": "other",
+		"Passenger AppPreloader: /var/www/ood/apps/sys/dashboard":         "passenger_preloader",
+		"/usr/bin/python3 /opt/passenger/helper-scripts/wsgi-loader.py":   "python",
+		"nginx: worker process":                                                         "nginx",
+		"ssh -o ServerAliveInterval=30 -t owens.osc.edu":                                "shell",
+		"/usr/bin/ssh owens.osc.edu":                                                    "shell",
+		"rsync -a /users/foo/src /users/foo/dst":                                        "file_transfer",
+		"git clone https://github.com/OSC/ondemand.git":                                 "git",
+		"/usr/libexec/git-core/git-remote-https origin https://github.com/OSC/ondemand": "git",
+		"sshd: foo@pts/0":                                                               "other",
+	}
+	for cmdline, expected := range tests {
+		if val := classifyProcess(kinds, cmdline, ""); val != expected {
+			t.Errorf("Unexpected kind for %q, expected %s, got %s", cmdline, expected, val)
+		}
+	}
+	if val := classifyProcess(kinds, "", "ssh"); val != "shell" {
+		t.Errorf("Unexpected kind for comm ssh, expected shell, got %s", val)
+	}
+}
+
+func TestGetProcessKindsInvalid(t *testing.T) {
+	for _, arg := range []string{"--collector.process.kind=foo", "--collector.process.kind=foo=(", "--collector.process.kind==bar"} {
+		*processKinds = nil
+		if _, err := kingpin.CommandLine.Parse([]string{arg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getProcessKinds(); err == nil {
+			t.Errorf("Expected error for %s", arg)
+		}
+	}
+	*processKinds = nil
+	_, _ = kingpin.CommandLine.Parse([]string{})
+}
+
+func TestGetProcessMetricsShellSessions(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	procFS = filepath.Join(dir, "../fixtures/proc")
+	defer func() { timeNow = getTimeNow }()
+	timeNow = func() time.Time {
+		return time.Unix(1587100000, 0)
+	}
+	m, err := getProcessMetrics(context.Background(), getTestSnapshot(t), []string{"30001"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if val := len(m.ShellSessions); val != 2 {
+		t.Errorf("Unexpected number of shell session hosts, expected 2, got %d", val)
+	}
+	owens := m.ShellSessions["owens.osc.edu"]
+	if owens.Count != 2 {
+		t.Errorf("Unexpected shell sessions for owens.osc.edu, expected 2, got %d", owens.Count)
+	}
+	if owens.Sum != 90600 {
+		t.Errorf("Unexpected shell session age sum for owens.osc.edu, expected 90600, got %v", owens.Sum)
+	}
+	if val := owens.Buckets[900]; val != 1 {
+		t.Errorf("Unexpected shell sessions for owens.osc.edu in bucket 900, expected 1, got %d", val)
+	}
+	if val := owens.Buckets[604800]; val != 2 {
+		t.Errorf("Unexpected shell sessions for owens.osc.edu in bucket 604800, expected 2, got %d", val)
+	}
+	pitzer := m.ShellSessions["pitzer-login01.osc.edu"]
+	if pitzer.Count != 1 || pitzer.Sum != 7200 {
+		t.Errorf("Unexpected shell sessions for pitzer-login01.osc.edu, expected 1 with age 7200, got %d with age %v", pitzer.Count, pitzer.Sum)
+	}
+	if _, ok := m.ShellSessions["jump.osc.edu"]; ok {
+		t.Errorf("Unexpected shell session for the ProxyJump ssh to jump.osc.edu")
+	}
+	if val := m.Kinds["shell"].Processes; val != 5 {
+		t.Errorf("Unexpected processes for kind shell, expected 5, got %v", val)
+	}
+}
+
+func TestParseSSHHost(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"owens.osc.edu"}, "owens.osc.edu"},
+		{[]string{"-o", "ServerAliveInterval=30", "-t", "owens.osc.edu"}, "owens.osc.edu"},
+		{[]string{"-p", "22", "-l", "foo", "pitzer.osc.edu", "hostname"}, "pitzer.osc.edu"},
+		{[]string{"-tt", "foo@owens.osc.edu"}, "owens.osc.edu"},
+		{[]string{"-lfoo", "-A", "owens.osc.edu"}, "owens.osc.edu"},
+		{[]string{"-4", "--", "owens.osc.edu"}, "owens.osc.edu"},
+		{[]string{"ssh://foo@owens.osc.edu:2222"}, "owens.osc.edu"},
+		{[]string{"-o", "ServerAliveInterval=30"}, ""},
+		{[]string{}, ""},
+	}
+	for _, test := range tests {
+		if val := parseSSHHost(test.args); val != test.expected {
+			t.Errorf("Unexpected host for %v, expected %q, got %q", test.args, test.expected, val)
+		}
+	}
+}
+
+func TestGetProcessMetricsStates(t *testing.T) {
+	_, filename, _, _ := runtime.Caller(0)
+	dir := filepath.Dir(filename)
+	procFS = filepath.Join(dir, "../fixtures/proc")
+	defer func() {
+		timeNow = getTimeNow
+		processStateTracker = newProcessDStateTracker()
+	}()
+	processStateTracker = newProcessDStateTracker()
+	now := time.Unix(1587100000, 0)
+	timeNow = func() time.Time {
+		return now
+	}
+	m, err := getProcessMetrics(context.Background(), getTestSnapshot(t), []string{"30001", "20821"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expectedStates := map[string]float64{"R": 0, "S": 11, "D": 1, "Z": 1, "T": 0}
+	for state, expected := range expectedStates {
+		if val := m.States[state]; val != expected {
+			t.Errorf("Unexpected processes in state %s, expected %v, got %v", state, expected, val)
+		}
+	}
+	if val := m.Threads; val != 39 {
+		t.Errorf("Unexpected value for Threads, expected 39, got %v", val)
+	}
+	if val := m.HungPuns; val != 0 {
+		t.Errorf("Unexpected value for HungPuns on first collection, expected 0, got %v", val)
+	}
+	now = now.Add(time.Minute)
+	m, err = getProcessMetrics(context.Background(), getTestSnapshot(t), []string{"30001", "20821"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if val := m.HungPuns; val != 0 {
+		t.Errorf("Unexpected value for HungPuns before threshold, expected 0, got %v", val)
+	}
+	now = now.Add(time.Minute)
+	m, err = getProcessMetrics(context.Background(), getTestSnapshot(t), []string{"30001", "20821"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if val := m.HungPuns; val != 1 {
+		t.Errorf("Unexpected value for HungPuns after threshold, expected 1, got %v", val)
+	}
+}
+
+func TestProcessDStateTracker(t *testing.T) {
+	tracker := newProcessDStateTracker()
+	now := time.Unix(1587100000, 0)
+	procs := []punProcess{
+		{pid: 1000, uid: "20821", starttime: 100},
+		{pid: 1001, uid: "20821", starttime: 110},
+		{pid: 2000, uid: "30001", starttime: 200},
+	}
+	if val := tracker.update(procs, now, time.Minute, false); val != 0 {
+		t.Errorf("Unexpected hung PUNs, expected 0, got %d", val)
+	}
+	// PID 2000 was reused by a new process so it starts over
+	procs[2].starttime = 300
+	if val := tracker.update(procs, now.Add(time.Minute), time.Minute, false); val != 1 {
+		t.Errorf("Unexpected hung PUNs, expected 1, got %d", val)
+	}
+	if val := tracker.update(procs, now.Add(2*time.Minute), time.Minute, false); val != 2 {
+		t.Errorf("Unexpected hung PUNs, expected 2, got %d", val)
+	}
+	// Processes that left D state are forgotten
+	if val := tracker.update(procs[2:], now.Add(3*time.Minute), time.Minute, false); val != 1 {
+		t.Errorf("Unexpected hung PUNs, expected 1, got %d", val)
+	}
+	if val := tracker.update(procs, now.Add(4*time.Minute), time.Minute, false); val != 1 {
+		t.Errorf("Unexpected hung PUNs, expected 1, got %d", val)
+	}
+	if val := len(tracker.since); val != 3 {
+		t.Errorf("Unexpected tracked processes, expected 3, got %d", val)
+	}
+	// Processes missing from partial results are kept
+	if val := tracker.update(procs[:1], now.Add(5*time.Minute), time.Minute, true); val != 2 {
+		t.Errorf("Unexpected hung PUNs for partial results, expected 2, got %d", val)
+	}
+	if val := len(tracker.since); val != 3 {
+		t.Errorf("Unexpected tracked processes for partial results, expected 3, got %d", val)
+	}
+}
+
+// cancelAfterContext is a context that is done after Err has been checked a number of times
+type cancelAfterContext struct {
+	context.Context
+	mutex  sync.Mutex
+	checks int
+}
+
+func (c *cancelAfterContext) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.checks <= 0 {
+		return context.DeadlineExceeded
+	}
+	c.checks--
+	return nil
+}
+
+func TestGetProcessMetricsCancel(t *testing.T) {
+	defer func() { processStateTracker = newProcessDStateTracker() }()
+	snapshot := getTestSnapshot(t)
+	ctx := &cancelAfterContext{Context: context.Background(), checks: 8}
+	m, err := getProcessMetrics(ctx, snapshot, []string{"32666", "20821"}, promslog.NewNopLogger())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded error, got %v", err)
+	}
+	if !m.Partial {
+		t.Errorf("Expected partial results")
+	}
+	// The first 8 processes by PID include 3 processes of 32666 and 2 rack apps of 20821
+	if val := m.RackApps; val != 2 {
+		t.Errorf("Unexpected value for RackApps, expected 2, got %v", val)
+	}
+	if val := m.Kinds["passenger_core"].Processes; val != 1 {
+		t.Errorf("Unexpected processes for kind passenger_core, expected 1, got %v", val)
+	}
+	if val := m.NodeApps; val != 0 {
+		t.Errorf("Unexpected value for NodeApps, expected 0, got %v", val)
+	}
+	snapshot.Partial = true
+	m, err = getProcessMetrics(context.Background(), snapshot, []string{"32666", "20821"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if !m.Partial {
+		t.Errorf("Expected partial results from partial snapshot")
+	}
+}
+
+func TestProcessCollectorTimeout(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.process.timeout=0"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _ = kingpin.CommandLine.Parse([]string{})
+		processStateTracker = newProcessDStateTracker()
+	}()
+	expected := `
+		# HELP ondemand_exporter_collect_partial Indicates the collector returned partial results
+		# TYPE ondemand_exporter_collect_partial gauge
+		ondemand_exporter_collect_partial{collector="process"} 1
+		# HELP ondemand_exporter_collect_timeout Indicates the collector timed out
+		# TYPE ondemand_exporter_collect_timeout gauge
+		ondemand_exporter_collect_timeout{collector="process"} 1
+		# HELP ondemand_rack_apps Number of running Rack apps
+		# TYPE ondemand_rack_apps gauge
+		ondemand_rack_apps 0
+	`
+	snapshot := getTestSnapshot(t)
+	// Collect concurrently so the race detector checks timeouts
+	wg := &sync.WaitGroup{}
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			collector := NewProcessCollector(promslog.NewNopLogger())
+			c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666", "20821"}, ch) })
+			if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_exporter_collect_partial",
+				"ondemand_exporter_collect_timeout", "ondemand_rack_apps"); err != nil {
+				t.Errorf("unexpected collecting result:\n%s", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestProcessCollector(t *testing.T) {
+	defer func() { processStateTracker = newProcessDStateTracker() }()
+	expected := `
+		# HELP ondemand_exporter_collect_partial Indicates the collector returned partial results
+		# TYPE ondemand_exporter_collect_partial gauge
+		ondemand_exporter_collect_partial{collector="process"} 0
+		# HELP ondemand_exporter_collect_timeout Indicates the collector timed out
+		# TYPE ondemand_exporter_collect_timeout gauge
+		ondemand_exporter_collect_timeout{collector="process"} 0
+		# HELP ondemand_rack_apps Number of running Rack apps
+		# TYPE ondemand_rack_apps gauge
+		ondemand_rack_apps 4
+	`
+	collector := NewProcessCollector(promslog.NewNopLogger())
+	snapshot := getTestSnapshot(t)
+	c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666", "20821"}, ch) })
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_exporter_collect_partial",
+		"ondemand_exporter_collect_timeout", "ondemand_rack_apps"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestProcessCollectorSnapshotDeadline(t *testing.T) {
+	defer func() { processStateTracker = newProcessDStateTracker() }()
+	expected := `
+		# HELP ondemand_exporter_collect_timeout Indicates the collector timed out
+		# TYPE ondemand_exporter_collect_timeout gauge
+		ondemand_exporter_collect_timeout{collector="process"} 1
+	`
+	// The snapshot used up the deadline of the scrape
+	snapshot := getTestSnapshot(t)
+	snapshot.Deadline = time.Now().Add(-time.Second)
+	collector := NewProcessCollector(promslog.NewNopLogger())
+	c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666", "20821"}, ch) })
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_exporter_collect_timeout"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestGetProcessMetricsSmaps(t *testing.T) {
+	defer func() { processIOTracker = newProcessIOCounterTracker() }()
+	processIOTracker = newProcessIOCounterTracker()
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.process.smaps"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = kingpin.CommandLine.Parse([]string{}) }()
+	lookupUserID = func(uid string) (*user.User, error) {
+		usernames := map[string]string{"32666": "msqueo", "20821": "tdockendorf"}
+		return &user.User{Uid: uid, Username: usernames[uid]}, nil
+	}
+	userLookups = newUserLookupCache()
+	defer func() {
+		lookupUserID = user.LookupId
+		userLookups = newUserLookupCache()
+	}()
+	m, err := getProcessMetrics(context.Background(), getTestSnapshot(t), []string{"32666", "20821"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if val := m.PunMemoryPSS; val != 118879232 {
+		t.Errorf("Unexpected value for PunMemoryPSS, expected 118879232, got %v", val)
+	}
+	if val := m.PunMemoryUSS; val != 104017920 {
+		t.Errorf("Unexpected value for PunMemoryUSS, expected 104017920, got %v", val)
+	}
+	if val := m.PunMemorySwap; val != 3670016 {
+		t.Errorf("Unexpected value for PunMemorySwap, expected 3670016, got %v", val)
+	}
+	// 85681 has no smaps_rollup as if it exited after the snapshot
+	if val := m.SmapsMissing; val != 1 {
+		t.Errorf("Unexpected value for SmapsMissing, expected 1, got %v", val)
+	}
+	expectedUsers := map[string]ProcessUserMetrics{
+		"msqueo": {MemoryPSS: 15024128, MemoryUSS: 13145088, MemorySwap: 524288,
+			OpenFDs: 65, FDUtilization: 0.75, ReadBytes: 2056192, WriteBytes: 1437696, Threads: 22},
+		"tdockendorf": {MemoryPSS: 103855104, MemoryUSS: 90872832, MemorySwap: 3145728,
+			OpenFDs: 8, ReadBytes: 52428800, WriteBytes: 1048576, Threads: 28},
+	}
+	if !reflect.DeepEqual(m.Users, expectedUsers) {
+		t.Errorf("Unexpected user metrics\nExpected\n%v\nGot\n%v", expectedUsers, m.Users)
+	}
+	if val := fmt.Sprintf("%.2f", m.PunMemoryPercent); val != "0.71" {
+		t.Errorf("Unexpected value for PunMemoryPercent, expected 0.71, got %v", val)
+	}
+	if val := m.PunMemoryRSS; val != 338735104 {
+		t.Errorf("Unexpected value for PunMemoryRSS, expected 338735104, got %v", val)
+	}
+}
+
+func TestProcessCollectorSmaps(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.process.smaps"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = kingpin.CommandLine.Parse([]string{}) }()
+	lookupUserID = func(uid string) (*user.User, error) {
+		return &user.User{Uid: uid, Username: "msqueo"}, nil
+	}
+	userLookups = newUserLookupCache()
+	defer func() {
+		lookupUserID = user.LookupId
+		userLookups = newUserLookupCache()
+	}()
+	expected := `
+		# HELP ondemand_pun_memory Memory used by all PUNs
+		# TYPE ondemand_pun_memory gauge
+		ondemand_pun_memory{type="pss"} 15024128
+		ondemand_pun_memory{type="rss"} 37564416
+		ondemand_pun_memory{type="swap"} 524288
+		ondemand_pun_memory{type="uss"} 13145088
+		ondemand_pun_memory{type="vms"} 2157719552
+		# HELP ondemand_pun_smaps_missing_processes Number of PUN processes whose smaps_rollup could not be read
+		# TYPE ondemand_pun_smaps_missing_processes gauge
+		ondemand_pun_smaps_missing_processes 0
+		# HELP ondemand_pun_user_memory_bytes Memory used by the processes of a PUN
+		# TYPE ondemand_pun_user_memory_bytes gauge
+		ondemand_pun_user_memory_bytes{type="pss",user="msqueo"} 15024128
+		ondemand_pun_user_memory_bytes{type="swap",user="msqueo"} 524288
+		ondemand_pun_user_memory_bytes{type="uss",user="msqueo"} 13145088
+	`
+	collector := NewProcessCollector(promslog.NewNopLogger())
+	snapshot := getTestSnapshot(t)
+	c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666"}, ch) })
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_pun_memory",
+		"ondemand_pun_smaps_missing_processes", "ondemand_pun_user_memory_bytes"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
+
+func TestGetProcessMetricsFDs(t *testing.T) {
+	defer func() { processIOTracker = newProcessIOCounterTracker() }()
+	processIOTracker = newProcessIOCounterTracker()
+	m, err := getProcessMetrics(context.Background(), getTestSnapshot(t), []string{"32666", "20821"}, promslog.NewNopLogger())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if val := m.OpenFDs; val != 73 {
+		t.Errorf("Unexpected value for OpenFDs, expected 73, got %v", val)
+	}
+	// 71826 has 48 open files with a soft limit of 64, 85019 has no limit
+	if val := m.FDUtilization; val != 0.75 {
+		t.Errorf("Unexpected value for FDUtilization, expected 0.75, got %v", val)
+	}
+	if val := m.ReadBytes; val != 54484992 {
+		t.Errorf("Unexpected value for ReadBytes, expected 54484992, got %v", val)
+	}
+	if val := m.WriteBytes; val != 2486272 {
+		t.Errorf("Unexpected value for WriteBytes, expected 2486272, got %v", val)
+	}
+	if m.Users != nil {
+		t.Errorf("Unexpected user metrics without per-user enabled: %v", m.Users)
+	}
+}
+
+func TestProcessIOCounterTracker(t *testing.T) {
+	tracker := newProcessIOCounterTracker()
+	p1 := punProcess{pid: 1, uid: "1000", starttime: 10}
+	p2 := punProcess{pid: 2, uid: "1000", starttime: 20}
+	p3 := punProcess{pid: 3, uid: "1001", starttime: 30}
+	users, total := tracker.update([]punProcess{p1, p2, p3}, nil, map[punProcess]processIO{
+		p1: {read: 100, write: 10},
+		p2: {read: 200, write: 20},
+		p3: {read: 300, write: 30},
+	}, []string{"1000", "1001"}, false)
+	if users["1000"] != (processIO{read: 300, write: 30}) || total != (processIO{read: 600, write: 60}) {
+		t.Errorf("Unexpected I/O users=%v total=%v", users, total)
+	}
+	// p2 could not be read so keeps the last values
+	users, total = tracker.update([]punProcess{p1, p2, p3}, nil, map[punProcess]processIO{
+		p1: {read: 150, write: 15},
+		p3: {read: 300, write: 30},
+	}, []string{"1000", "1001"}, false)
+	if users["1000"] != (processIO{read: 350, write: 35}) || total != (processIO{read: 650, write: 65}) {
+		t.Errorf("Unexpected I/O with unread process users=%v total=%v", users, total)
+	}
+	// Partial results do not count p2 as exited
+	users, _ = tracker.update([]punProcess{p1}, nil, map[punProcess]processIO{
+		p1: {read: 150, write: 15},
+	}, []string{"1000", "1001"}, true)
+	if users["1000"] != (processIO{read: 350, write: 35}) {
+		t.Errorf("Unexpected I/O with partial results users=%v", users)
+	}
+	// p2 exits and p1 is replaced by a new process with the same PID
+	p1New := punProcess{pid: 1, uid: "1000", starttime: 40}
+	users, total = tracker.update([]punProcess{p1New, p3}, nil, map[punProcess]processIO{
+		p1New: {read: 5, write: 1},
+		p3:    {read: 310, write: 31},
+	}, []string{"1000", "1001"}, false)
+	if users["1000"] != (processIO{read: 355, write: 36}) || total != (processIO{read: 665, write: 67}) {
+		t.Errorf("Unexpected I/O after exit users=%v total=%v", users, total)
+	}
+	// The PUN of 1000 stops, its I/O remains in the total
+	users, total = tracker.update([]punProcess{p3}, nil, map[punProcess]processIO{
+		p3: {read: 310, write: 31},
+	}, []string{"1001"}, false)
+	if _, ok := users["1000"]; ok {
+		t.Errorf("Unexpected I/O for stopped PUN users=%v", users)
+	}
+	if total != (processIO{read: 665, write: 67}) {
+		t.Errorf("Unexpected total I/O after PUN stopped %v", total)
+	}
+}
+
+func TestProcessIOCounterTrackerReaped(t *testing.T) {
+	tracker := newProcessIOCounterTracker()
+	parent := punProcess{pid: 10, uid: "1000", starttime: 10}
+	child := punProcess{pid: 11, uid: "1000", starttime: 20}
+	orphan := punProcess{pid: 12, uid: "1000", starttime: 30}
+	parents := map[punProcess]int{parent: 1, child: 10, orphan: 1}
+	tracker.update([]punProcess{parent, child, orphan}, parents, map[punProcess]processIO{
+		parent: {read: 100, write: 10},
+		child:  {read: 50, write: 5},
+		orphan: {read: 20, write: 2},
+	}, []string{"1000"}, false)
+	// The child is reaped by the parent which now includes the I/O of the child,
+	// the orphan was reaped by a process that is not a PUN process
+	users, total := tracker.update([]punProcess{parent}, parents, map[punProcess]processIO{
+		parent: {read: 150, write: 15},
+	}, []string{"1000"}, false)
+	if users["1000"] != (processIO{read: 170, write: 17}) || total != (processIO{read: 170, write: 17}) {
+		t.Errorf("Unexpected I/O after reaped child users=%v total=%v", users, total)
+	}
+}
+
+func TestProcessCollectorPerUser(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.process.per-user"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _, _ = kingpin.CommandLine.Parse([]string{}) }()
+	defer func() { processIOTracker = newProcessIOCounterTracker() }()
+	processIOTracker = newProcessIOCounterTracker()
+	lookupUserID = func(uid string) (*user.User, error) {
+		return &user.User{Uid: uid, Username: "msqueo"}, nil
+	}
+	userLookups = newUserLookupCache()
+	defer func() {
+		lookupUserID = user.LookupId
+		userLookups = newUserLookupCache()
+	}()
+	expected := `
+		# HELP ondemand_pun_fd_utilization_ratio Highest ratio of open file descriptors to the soft limit of any PUN process
+		# TYPE ondemand_pun_fd_utilization_ratio gauge
+		ondemand_pun_fd_utilization_ratio 0.75
+		# HELP ondemand_pun_open_fds Number of open file descriptors of all PUN processes
+		# TYPE ondemand_pun_open_fds gauge
+		ondemand_pun_open_fds 65
+		# HELP ondemand_pun_read_bytes_total Bytes read from storage by PUN processes
+		# TYPE ondemand_pun_read_bytes_total counter
+		ondemand_pun_read_bytes_total 2056192
+		# HELP ondemand_pun_write_bytes_total Bytes written to storage by PUN processes
+		# TYPE ondemand_pun_write_bytes_total counter
+		ondemand_pun_write_bytes_total 1437696
+		# HELP ondemand_pun_user_fd_utilization_ratio Highest ratio of open file descriptors to the soft limit of any process of a PUN
+		# TYPE ondemand_pun_user_fd_utilization_ratio gauge
+		ondemand_pun_user_fd_utilization_ratio{user="msqueo"} 0.75
+		# HELP ondemand_pun_user_open_fds Number of open file descriptors of the processes of a PUN
+		# TYPE ondemand_pun_user_open_fds gauge
+		ondemand_pun_user_open_fds{user="msqueo"} 65
+		# HELP ondemand_pun_user_read_bytes_total Bytes read from storage by the processes of a PUN
+		# TYPE ondemand_pun_user_read_bytes_total counter
+		ondemand_pun_user_read_bytes_total{user="msqueo"} 2056192
+		# HELP ondemand_pun_user_threads Number of threads of the processes of a PUN
+		# TYPE ondemand_pun_user_threads gauge
+		ondemand_pun_user_threads{user="msqueo"} 22
+		# HELP ondemand_pun_user_write_bytes_total Bytes written to storage by the processes of a PUN
+		# TYPE ondemand_pun_user_write_bytes_total counter
+		ondemand_pun_user_write_bytes_total{user="msqueo"} 1437696
+	`
+	collector := NewProcessCollector(promslog.NewNopLogger())
+	snapshot := getTestSnapshot(t)
+	c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666"}, ch) })
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_pun_open_fds", "ondemand_pun_fd_utilization_ratio",
+		"ondemand_pun_read_bytes_total", "ondemand_pun_write_bytes_total", "ondemand_pun_user_open_fds", "ondemand_pun_user_fd_utilization_ratio",
+		"ondemand_pun_user_read_bytes_total", "ondemand_pun_user_write_bytes_total", "ondemand_pun_user_threads"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	// Per user memory is only reported with smaps enabled
+	if n := testutil.CollectAndCount(c, "ondemand_pun_user_memory_bytes"); n != 0 {
+		t.Errorf("Unexpected per user memory metrics without smaps: %d", n)
+	}
 }
@@ -0,0 +1,152 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+const (
+	pseudonymizeNone = "none"
+	pseudonymizeHMAC = "hmac"
+	pseudonymizeHash = "hash"
+	// Hex characters of the pseudonyms, 64 bits
+	pseudonymLength = 16
+)
+
+var (
+	pseudonymize = kingpin.Flag("collector.users.pseudonymize", "Replace usernames in labels with a keyed HMAC or a stable hash of the username").
+			Default(pseudonymizeNone).Envar("USERS_PSEUDONYMIZE").Enum(pseudonymizeNone, pseudonymizeHMAC, pseudonymizeHash)
+	pseudonymKeyFile = kingpin.Flag("collector.users.pseudonym-key-file", "File with the key of the HMAC of usernames, required with --collector.users.pseudonymize=hmac").Envar("USERS_PSEUDONYM_KEY_FILE").String()
+	pseudonymKey     []byte
+)
+
+// ConfigurePseudonyms reads the HMAC key of usernames, it must be called after the flags are parsed.
+func ConfigurePseudonyms() error {
+	pseudonymKey = nil
+	if *pseudonymize != pseudonymizeHMAC {
+		return nil
+	}
+	if *pseudonymKeyFile == "" {
+		return errors.New("--collector.users.pseudonym-key-file is required with --collector.users.pseudonymize=hmac")
+	}
+	key, err := os.ReadFile(*pseudonymKeyFile)
+	if err != nil {
+		return err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return fmt.Errorf("pseudonym key file %s is empty", *pseudonymKeyFile)
+	}
+	pseudonymKey = key
+	return nil
+}
+
+// pseudonym returns the pseudonym of a username or the username when pseudonyms are disabled.
+func pseudonym(username string) string {
+	var sum []byte
+	switch *pseudonymize {
+	case pseudonymizeHMAC:
+		mac := hmac.New(sha256.New, pseudonymKey)
+		mac.Write([]byte(username))
+		sum = mac.Sum(nil)
+	case pseudonymizeHash:
+		s := sha256.Sum256([]byte(username))
+		sum = s[:]
+	default:
+		return username
+	}
+	return hex.EncodeToString(sum)[:pseudonymLength]
+}
+
+// userLabel returns the value of a label of username.
+func userLabel(username string) string {
+	if username == "" {
+		return username
+	}
+	return pseudonym(username)
+}
+
+// appLabel returns the label of a Passenger app owned by username, replacing the username in its path.
+func appLabel(app string, username string) string {
+	if username == "" || pseudonym(username) == username {
+		return app
+	}
+	path, suffix, _ := strings.Cut(app, " ")
+	elements := strings.Split(path, "/")
+	for i, e := range elements {
+		if e == username {
+			elements[i] = pseudonym(username)
+		}
+	}
+	app = strings.Join(elements, "/")
+	if suffix != "" {
+		app = app + " " + suffix
+	}
+	return app
+}
+
+// ReversePseudonyms writes the candidate usernames whose pseudonym is one of pseudonyms.
+func ReversePseudonyms(pseudonyms []string, candidates io.Reader, w io.Writer) (int, error) {
+	if *pseudonymize == pseudonymizeNone {
+		return 0, errors.New("--collector.users.pseudonymize is not enabled")
+	}
+	wanted := make(map[string]bool)
+	for _, p := range pseudonyms {
+		wanted[strings.ToLower(p)] = false
+	}
+	scanner := bufio.NewScanner(candidates)
+	for scanner.Scan() {
+		username, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if username == "" {
+			continue
+		}
+		p := pseudonym(username)
+		found, ok := wanted[p]
+		if !ok || found {
+			continue
+		}
+		wanted[p] = true
+		if _, err := fmt.Fprintf(w, "%s %s\n", p, username); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	for _, found := range wanted {
+		if found {
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
@@ -0,0 +1,161 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"bytes"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/promslog"
+)
+
+func setupPseudonyms(t *testing.T, args ...string) {
+	t.Helper()
+	if _, err := kingpin.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigurePseudonyms(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		*pseudonymKeyFile = ""
+		_, _ = kingpin.CommandLine.Parse([]string{})
+		pseudonymKey = nil
+	})
+}
+
+func writePseudonymKey(t *testing.T, key string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPseudonym(t *testing.T) {
+	setupPseudonyms(t)
+	if val := userLabel("msqueo"); val != "msqueo" {
+		t.Errorf("Unexpected label without pseudonyms %s", val)
+	}
+	setupPseudonyms(t, "--collector.users.pseudonymize=hash")
+	if val := userLabel("msqueo"); val != "5a4b0b05a3a40cd2" {
+		t.Errorf("Unexpected hash pseudonym %s", val)
+	}
+	if val := userLabel(""); val != "" {
+		t.Errorf("Unexpected label of empty username %s", val)
+	}
+	setupPseudonyms(t, "--collector.users.pseudonymize=hmac", "--collector.users.pseudonym-key-file="+writePseudonymKey(t, "secret\n"))
+	if val := userLabel("msqueo"); val != "c5b02bcf4d648b06" {
+		t.Errorf("Unexpected HMAC pseudonym %s", val)
+	}
+}
+
+func TestConfigurePseudonyms(t *testing.T) {
+	setupPseudonyms(t)
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.users.pseudonymize=hmac"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigurePseudonyms(); err == nil {
+		t.Errorf("Expected error without key file")
+	}
+	*pseudonymKeyFile = writePseudonymKey(t, " \n")
+	if err := ConfigurePseudonyms(); err == nil {
+		t.Errorf("Expected error with empty key file")
+	}
+	*pseudonymKeyFile = filepath.Join(t.TempDir(), "missing")
+	if err := ConfigurePseudonyms(); err == nil {
+		t.Errorf("Expected error with missing key file")
+	}
+}
+
+func TestAppLabel(t *testing.T) {
+	setupPseudonyms(t)
+	app := "/users/PZS0002/msqueo/ondemand/dev/jobs (development)"
+	if val := appLabel(app, "msqueo"); val != app {
+		t.Errorf("Unexpected app label without pseudonyms %s", val)
+	}
+	setupPseudonyms(t, "--collector.users.pseudonymize=hash")
+	if val := appLabel(app, "msqueo"); val != "/users/PZS0002/5a4b0b05a3a40cd2/ondemand/dev/jobs (development)" {
+		t.Errorf("Unexpected app label %s", val)
+	}
+	sys := "/var/www/ood/apps/sys/dashboard (production)"
+	if val := appLabel(sys, "msqueo"); val != sys {
+		t.Errorf("Unexpected app label of system app %s", val)
+	}
+	if val := appLabel("/home/msqueo", "msqueo"); val != "/home/5a4b0b05a3a40cd2" {
+		t.Errorf("Unexpected app label without suffix %s", val)
+	}
+}
+
+func TestReversePseudonyms(t *testing.T) {
+	setupPseudonyms(t)
+	if _, err := ReversePseudonyms([]string{"5a4b0b05a3a40cd2"}, strings.NewReader("msqueo\n"), &bytes.Buffer{}); err == nil {
+		t.Errorf("Expected error without pseudonyms enabled")
+	}
+	setupPseudonyms(t, "--collector.users.pseudonymize=hash")
+	candidates := "root:x:0:0:root:/root:/bin/bash\n\nmsqueo:x:32666:32666::/home/msqueo:/bin/bash\nmsqueo\ntdockendorf\n"
+	out := &bytes.Buffer{}
+	found, err := ReversePseudonyms([]string{"5A4B0B05A3A40CD2", "0000000000000000"}, strings.NewReader(candidates), out)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if found != 1 {
+		t.Errorf("Unexpected pseudonyms found, expected 1, got %d", found)
+	}
+	if val := out.String(); val != "5a4b0b05a3a40cd2 msqueo\n" {
+		t.Errorf("Unexpected output %q", val)
+	}
+}
+
+func TestProcessCollectorPseudonyms(t *testing.T) {
+	setupPseudonyms(t, "--collector.process.smaps", "--collector.users.pseudonymize=hash")
+	lookupUserID = func(uid string) (*user.User, error) {
+		return &user.User{Uid: uid, Username: "msqueo"}, nil
+	}
+	userLookups = newUserLookupCache()
+	defer func() {
+		lookupUserID = user.LookupId
+		userLookups = newUserLookupCache()
+	}()
+	expected := `
+		# HELP ondemand_pun_user_memory_bytes Memory used by the processes of a PUN
+		# TYPE ondemand_pun_user_memory_bytes gauge
+		ondemand_pun_user_memory_bytes{type="pss",user="5a4b0b05a3a40cd2"} 15024128
+		ondemand_pun_user_memory_bytes{type="swap",user="5a4b0b05a3a40cd2"} 524288
+		ondemand_pun_user_memory_bytes{type="uss",user="5a4b0b05a3a40cd2"} 13145088
+	`
+	collector := NewProcessCollector(promslog.NewNopLogger())
+	snapshot := getTestSnapshot(t)
+	c := funcCollector(func(ch chan<- prometheus.Metric) { _ = collector.collect(snapshot, []string{"32666"}, ch) })
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected), "ondemand_pun_user_memory_bytes"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+}
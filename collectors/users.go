@@ -0,0 +1,275 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	userLookupName   = "name"
+	userLookupUID    = "uid"
+	userLookupGroup  = "group"
+	userLookupMember = "member"
+)
+
+var (
+	userCacheTTL          = kingpin.Flag("collector.users.cache-ttl", "Duration to cache user and group lookups, 0 disables the cache").Default("15m").Envar("USERS_CACHE_TTL").Duration()
+	userLookupTimeout     = kingpin.Flag("collector.users.lookup-timeout", "Timeout for each user or group lookup, 0 disables the timeout").Default("2s").Envar("USERS_LOOKUP_TIMEOUT").Duration()
+	userLookupConcurrency = kingpin.Flag("collector.users.concurrency", "Number of user and group lookups to run concurrently").Default("4").Envar("USERS_CONCURRENCY").Int()
+	userLookups           = newUserLookupCache()
+	userLookupKinds       = []string{userLookupName, userLookupUID, userLookupGroup, userLookupMember}
+	userLookupBuckets     = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2, 5}
+	errUserLookupTimeout  = errors.New("user lookup timed out")
+	userLookupDuration    = prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "user_lookup_duration_seconds"),
+		"Duration of user and group lookups that were not cached", []string{"type"}, nil)
+	userLookupFailures = prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter", "user_lookup_failures_total"),
+		"Number of user and group lookups that failed or timed out", []string{"type", "reason"}, nil)
+)
+
+type userLookupEntry struct {
+	value   any
+	err     error
+	expires time.Time
+}
+
+// userLookupCall is a lookup in progress, value and err are set before done is closed.
+type userLookupCall struct {
+	done  chan struct{}
+	value any
+	err   error
+}
+
+// UserLookupResult is the user found for a username or the error looking it up.
+type UserLookupResult struct {
+	User *user.User
+	Err  error
+}
+
+// userLookupCache caches username, UID and group lookups, which may be slow with SSSD or LDAP.
+type userLookupCache struct {
+	sync.Mutex
+	limit     chan struct{}
+	entries   map[string]map[string]userLookupEntry
+	pending   map[string]map[string]*userLookupCall
+	durations map[string]Histogram
+	failures  map[string]map[string]float64
+}
+
+func newUserLookupCache() *userLookupCache {
+	c := &userLookupCache{
+		entries:   make(map[string]map[string]userLookupEntry),
+		pending:   make(map[string]map[string]*userLookupCall),
+		durations: make(map[string]Histogram),
+		failures:  make(map[string]map[string]float64),
+	}
+	for _, kind := range userLookupKinds {
+		c.entries[kind] = make(map[string]userLookupEntry)
+		c.pending[kind] = make(map[string]*userLookupCall)
+		c.durations[kind] = newHistogram(userLookupBuckets)
+		c.failures[kind] = map[string]float64{"error": 0, "timeout": 0}
+	}
+	return c
+}
+
+// lookup returns the user of a username or UID depending on kind.
+func (c *userLookupCache) lookup(ctx context.Context, kind string, key string) (*user.User, error) {
+	v, err := c.get(ctx, kind, key, func() (any, error) {
+		switch kind {
+		case userLookupName:
+			return lookupUser(key)
+		case userLookupUID:
+			return lookupUserID(key)
+		}
+		return nil, fmt.Errorf("unknown user lookup type %s", kind)
+	})
+	u, _ := v.(*user.User)
+	if err == nil && u == nil {
+		err = fmt.Errorf("no user found for %s %s", kind, key)
+	}
+	return u, err
+}
+
+// lookupGroup returns the group of a GID.
+func (c *userLookupCache) lookupGroup(ctx context.Context, gid string) (*user.Group, error) {
+	v, err := c.get(ctx, userLookupGroup, gid, func() (any, error) {
+		return lookupGroupID(gid)
+	})
+	g, _ := v.(*user.Group)
+	if err == nil && g == nil {
+		err = fmt.Errorf("no group found for gid %s", gid)
+	}
+	return g, err
+}
+
+// lookupGroupIDs returns the GIDs of the groups a user is a member of.
+func (c *userLookupCache) lookupGroupIDs(ctx context.Context, u *user.User) ([]string, error) {
+	v, err := c.get(ctx, userLookupMember, u.Username, func() (any, error) {
+		return lookupGroupIDs(u)
+	})
+	gids, _ := v.([]string)
+	return gids, err
+}
+
+// get returns the cached value of key or looks it up with fn.
+func (c *userLookupCache) get(ctx context.Context, kind string, key string, fn func() (any, error)) (any, error) {
+	c.Lock()
+	now := timeNow()
+	if e, ok := c.entries[kind][key]; ok && now.Before(e.expires) {
+		c.Unlock()
+		return e.value, e.err
+	}
+	call, ok := c.pending[kind][key]
+	if !ok {
+		c.prune(now)
+		call = &userLookupCall{done: make(chan struct{})}
+		c.pending[kind][key] = call
+		go c.resolve(kind, key, fn, call)
+	}
+	c.Unlock()
+	var timeout <-chan time.Time
+	if *userLookupTimeout > 0 {
+		timer := time.NewTimer(*userLookupTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-call.done:
+		return call.value, call.err
+	case <-timeout:
+		c.Lock()
+		c.failures[kind]["timeout"]++
+		c.Unlock()
+		return nil, fmt.Errorf("%w after %s: %s %s", errUserLookupTimeout, *userLookupTimeout, kind, key)
+	case <-ctx.Done():
+		c.Lock()
+		c.failures[kind]["timeout"]++
+		c.Unlock()
+		return nil, fmt.Errorf("%w: %s %s: %w", errUserLookupTimeout, kind, key, ctx.Err())
+	}
+}
+
+// prune removes expired entries, c must be locked.
+func (c *userLookupCache) prune(now time.Time) {
+	for _, entries := range c.entries {
+		for k, e := range entries {
+			if !now.Before(e.expires) {
+				delete(entries, k)
+			}
+		}
+	}
+}
+
+// resolve looks up a key with fn and caches the result.
+func (c *userLookupCache) resolve(kind string, key string, fn func() (any, error), call *userLookupCall) {
+	limit := c.limiter()
+	limit <- struct{}{}
+	start := time.Now()
+	v, err := fn()
+	elapsed := time.Since(start).Seconds()
+	<-limit
+	now := timeNow()
+	expires := now.Add(*userCacheTTL)
+	c.Lock()
+	defer c.Unlock()
+	h := c.durations[kind]
+	h.observe(elapsed)
+	c.durations[kind] = h
+	if err != nil {
+		c.failures[kind]["error"]++
+		if !isUnknownUser(err) {
+			expires = now
+		}
+	}
+	if now.Before(expires) {
+		c.entries[kind][key] = userLookupEntry{value: v, err: err, expires: expires}
+		// A found user also answers the lookup in the other direction
+		if u, ok := v.(*user.User); ok && err == nil && u != nil {
+			switch kind {
+			case userLookupName:
+				c.entries[userLookupUID][u.Uid] = userLookupEntry{value: u, expires: expires}
+			case userLookupUID:
+				c.entries[userLookupName][u.Username] = userLookupEntry{value: u, expires: expires}
+			}
+		}
+	}
+	call.value = v
+	call.err = err
+	delete(c.pending[kind], key)
+	close(call.done)
+}
+
+// limiter returns the semaphore bounding the lookups that run at a time.
+func (c *userLookupCache) limiter() chan struct{} {
+	c.Lock()
+	defer c.Unlock()
+	if c.limit == nil {
+		c.limit = make(chan struct{}, max(*userLookupConcurrency, 1))
+	}
+	return c.limit
+}
+
+// lookupUsers looks up usernames concurrently, the results are in the same order as names.
+func (c *userLookupCache) lookupUsers(ctx context.Context, names []string) []UserLookupResult {
+	results := make([]UserLookupResult, len(names))
+	wg := &sync.WaitGroup{}
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			u, err := c.lookup(ctx, userLookupName, name)
+			results[i] = UserLookupResult{User: u, Err: err}
+		}(i, name)
+	}
+	wg.Wait()
+	return results
+}
+
+func (c *userLookupCache) collect(ch chan<- prometheus.Metric) {
+	c.Lock()
+	defer c.Unlock()
+	for _, kind := range userLookupKinds {
+		h := c.durations[kind].copy()
+		ch <- prometheus.MustNewConstHistogram(userLookupDuration, h.Count, h.Sum, h.Buckets, kind)
+		for reason, value := range c.failures[kind] {
+			ch <- prometheus.MustNewConstMetric(userLookupFailures, prometheus.CounterValue, value, kind, reason)
+		}
+	}
+}
+
+// isUnknownUser returns true if err is from looking up a user or group that does not exist.
+func isUnknownUser(err error) bool {
+	var unknownUser user.UnknownUserError
+	var unknownUserID user.UnknownUserIdError
+	var unknownGroup user.UnknownGroupError
+	var unknownGroupID user.UnknownGroupIdError
+	return errors.As(err, &unknownUser) || errors.As(err, &unknownUserID) || errors.As(err, &unknownGroup) || errors.As(err, &unknownGroupID)
+}
@@ -0,0 +1,341 @@
+// MIT License
+//
+// Copyright (c) 2020 Ohio Supercomputer Center
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package collectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/user"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUserLookupCache(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(10000, 0)
+	timeNow = func() time.Time {
+		return now
+	}
+	var nameLookups, uidLookups int
+	lookupUser = func(username string) (*user.User, error) {
+		nameLookups++
+		switch username {
+		case "msqueo":
+			return &user.User{Uid: "32666", Username: username}, nil
+		case "unknown":
+			return nil, user.UnknownUserError(username)
+		}
+		return nil, fmt.Errorf("sssd unavailable")
+	}
+	lookupUserID = func(uid string) (*user.User, error) {
+		uidLookups++
+		return nil, user.UnknownUserIdError(32666)
+	}
+	defer func() {
+		timeNow = getTimeNow
+		lookupUser = user.Lookup
+		lookupUserID = user.LookupId
+	}()
+	c := newUserLookupCache()
+	ctx := context.Background()
+	for range 2 {
+		u, err := c.lookup(ctx, userLookupName, "msqueo")
+		if err != nil || u.Uid != "32666" {
+			t.Fatalf("Unexpected lookup result %v %v", u, err)
+		}
+	}
+	if nameLookups != 1 {
+		t.Errorf("Unexpected username lookups, expected 1, got %d", nameLookups)
+	}
+	// The UID was cached by the username lookup
+	if u, err := c.lookup(ctx, userLookupUID, "32666"); err != nil || u.Username != "msqueo" {
+		t.Errorf("Unexpected UID lookup result %v %v", u, err)
+	}
+	if uidLookups != 0 {
+		t.Errorf("Unexpected UID lookups, expected 0, got %d", uidLookups)
+	}
+	// Unknown users are cached, other errors are not
+	for range 2 {
+		if _, err := c.lookup(ctx, userLookupName, "unknown"); err == nil {
+			t.Errorf("Expected error for unknown user")
+		}
+		if _, err := c.lookup(ctx, userLookupName, "error"); err == nil {
+			t.Errorf("Expected error for failed lookup")
+		}
+	}
+	if nameLookups != 4 {
+		t.Errorf("Unexpected username lookups, expected 4, got %d", nameLookups)
+	}
+	if val := c.failures[userLookupName]["error"]; val != 3 {
+		t.Errorf("Unexpected lookup errors, expected 3, got %v", val)
+	}
+	if val := c.durations[userLookupName].Count; val != 4 {
+		t.Errorf("Unexpected lookup duration count, expected 4, got %d", val)
+	}
+	// Entries expire after the TTL
+	now = now.Add(*userCacheTTL)
+	if _, err := c.lookup(ctx, userLookupName, "msqueo"); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if nameLookups != 5 {
+		t.Errorf("Unexpected username lookups after TTL, expected 5, got %d", nameLookups)
+	}
+	if _, ok := c.entries[userLookupName]["unknown"]; ok {
+		t.Errorf("Expired entry was not removed")
+	}
+}
+
+func TestUserLookupCacheTimeout(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.users.lookup-timeout=10ms"}); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	lookupUser = func(username string) (*user.User, error) {
+		<-release
+		return &user.User{Uid: "32666", Username: username}, nil
+	}
+	defer func() {
+		lookupUser = user.Lookup
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	c := newUserLookupCache()
+	_, err := c.lookup(context.Background(), userLookupName, "msqueo")
+	if !errors.Is(err, errUserLookupTimeout) {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	if val := c.failures[userLookupName]["timeout"]; val != 1 {
+		t.Errorf("Unexpected lookup timeouts, expected 1, got %v", val)
+	}
+	// The lookup that timed out caches its result when it finishes
+	close(release)
+	c.Lock()
+	call := c.pending[userLookupName]["msqueo"]
+	c.Unlock()
+	if call != nil {
+		<-call.done
+	}
+	u, err := c.lookup(context.Background(), userLookupName, "msqueo")
+	if err != nil || u.Uid != "32666" {
+		t.Errorf("Unexpected lookup result %v %v", u, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// A canceled collection stops waiting for a lookup that is still running
+	c = newUserLookupCache()
+	c.Lock()
+	c.pending[userLookupName]["blocked"] = &userLookupCall{done: make(chan struct{})}
+	c.Unlock()
+	if _, err := c.lookup(ctx, userLookupName, "blocked"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected canceled error, got %v", err)
+	}
+}
+
+func TestLookupUsers(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.users.concurrency=2"}); err != nil {
+		t.Fatal(err)
+	}
+	var running, maxRunning atomic.Int32
+	lookupUser = func(username string) (*user.User, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		if username == "missing" {
+			return nil, user.UnknownUserError(username)
+		}
+		return &user.User{Uid: strings.TrimPrefix(username, "user"), Username: username}, nil
+	}
+	defer func() {
+		lookupUser = user.Lookup
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	names := []string{"user1", "user2", "missing", "user4", "user5"}
+	results := newUserLookupCache().lookupUsers(context.Background(), names)
+	if val := maxRunning.Load(); val > 2 {
+		t.Errorf("Unexpected concurrent lookups, expected at most 2, got %d", val)
+	}
+	for i, result := range results {
+		if names[i] == "missing" {
+			if result.Err == nil {
+				t.Errorf("Expected error for missing user")
+			}
+			continue
+		}
+		if result.Err != nil || result.User.Username != names[i] {
+			t.Errorf("Unexpected result for %s: %v %v", names[i], result.User, result.Err)
+		}
+	}
+}
+
+func TestUserLookupCacheLimit(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.users.concurrency=2", "--collector.users.lookup-timeout=10ms"}); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	var running, maxRunning atomic.Int32
+	lookup := func() {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		<-release
+	}
+	lookupUser = func(username string) (*user.User, error) {
+		lookup()
+		return &user.User{Uid: strings.TrimPrefix(username, "user"), Username: username}, nil
+	}
+	lookupUserID = func(uid string) (*user.User, error) {
+		lookup()
+		return &user.User{Uid: uid, Username: "user" + uid}, nil
+	}
+	defer func() {
+		lookupUser = user.Lookup
+		lookupUserID = user.LookupId
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	c := newUserLookupCache()
+	// Lookups that time out keep their slot until they finish, including UID lookups of getUsername
+	for _, result := range c.lookupUsers(context.Background(), []string{"user1", "user2", "user3", "user4"}) {
+		if !errors.Is(result.Err, errUserLookupTimeout) {
+			t.Errorf("Expected timeout error, got %v", result.Err)
+		}
+	}
+	if _, err := c.lookup(context.Background(), userLookupUID, "5"); !errors.Is(err, errUserLookupTimeout) {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+	if val := maxRunning.Load(); val != 2 {
+		t.Errorf("Unexpected concurrent lookups, expected 2, got %d", val)
+	}
+	close(release)
+	for {
+		c.Lock()
+		pending := len(c.pending[userLookupName]) + len(c.pending[userLookupUID])
+		c.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if val := maxRunning.Load(); val != 2 {
+		t.Errorf("Unexpected concurrent lookups, expected at most 2, got %d", val)
+	}
+}
+
+// checkConcurrentLookups runs lookupUsers from several goroutines and fails on any result without a user or error.
+func checkConcurrentLookups(t *testing.T, c *userLookupCache) {
+	t.Helper()
+	names := []string{"user1", "user2", "user3", "user4", "user5", "user6"}
+	var nilResults atomic.Int32
+	wg := &sync.WaitGroup{}
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				for _, result := range c.lookupUsers(context.Background(), names) {
+					if result.User == nil && result.Err == nil {
+						nilResults.Add(1)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val := nilResults.Load(); val != 0 {
+		t.Errorf("Unexpected lookup results without user or error: %d", val)
+	}
+}
+
+func TestLookupUsersConcurrentNoCache(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{"--collector.users.cache-ttl=0"}); err != nil {
+		t.Fatal(err)
+	}
+	lookupUser = func(username string) (*user.User, error) {
+		return &user.User{Uid: strings.TrimPrefix(username, "user"), Username: username}, nil
+	}
+	defer func() {
+		lookupUser = user.Lookup
+		_, _ = kingpin.CommandLine.Parse([]string{})
+	}()
+	checkConcurrentLookups(t, newUserLookupCache())
+}
+
+func TestLookupUsersConcurrentErrors(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	lookupUser = func(username string) (*user.User, error) {
+		return nil, fmt.Errorf("sssd unavailable")
+	}
+	defer func() { lookupUser = user.Lookup }()
+	checkConcurrentLookups(t, newUserLookupCache())
+}
+
+func TestUserLookupCacheCollect(t *testing.T) {
+	if _, err := kingpin.CommandLine.Parse([]string{}); err != nil {
+		t.Fatal(err)
+	}
+	lookupUserID = func(uid string) (*user.User, error) {
+		return nil, user.UnknownUserIdError(1)
+	}
+	defer func() { lookupUserID = user.LookupId }()
+	c := newUserLookupCache()
+	_, _ = c.lookup(context.Background(), userLookupUID, "1")
+	expected := `
+		# HELP ondemand_exporter_user_lookup_failures_total Number of user and group lookups that failed or timed out
+		# TYPE ondemand_exporter_user_lookup_failures_total counter
+		ondemand_exporter_user_lookup_failures_total{reason="error",type="group"} 0
+		ondemand_exporter_user_lookup_failures_total{reason="error",type="member"} 0
+		ondemand_exporter_user_lookup_failures_total{reason="error",type="name"} 0
+		ondemand_exporter_user_lookup_failures_total{reason="error",type="uid"} 1
+		ondemand_exporter_user_lookup_failures_total{reason="timeout",type="group"} 0
+		ondemand_exporter_user_lookup_failures_total{reason="timeout",type="member"} 0
+		ondemand_exporter_user_lookup_failures_total{reason="timeout",type="name"} 0
+		ondemand_exporter_user_lookup_failures_total{reason="timeout",type="uid"} 0
+	`
+	collector := funcCollector(c.collect)
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "ondemand_exporter_user_lookup_failures_total"); err != nil {
+		t.Errorf("unexpected collecting result:\n%s", err)
+	}
+	if val := testutil.CollectAndCount(collector, "ondemand_exporter_user_lookup_duration_seconds"); val != 4 {
+		t.Errorf("Unexpected lookup duration series, expected 4, got %d", val)
+	}
+}
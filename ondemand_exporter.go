@@ -38,7 +38,8 @@ import (
 )
 
 var (
-	listenAddr = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9301").Envar("LISTEN_ADDRESS").String()
+	listenAddr        = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9301").Envar("LISTEN_ADDRESS").String()
+	reversePseudonyms = kingpin.Flag("pseudonym.reverse", "Print the usernames read from stdin whose pseudonym is HASH and exit, may be repeated.").PlaceHolder("HASH").Strings()
 )
 
 func metricsHandler(logger *slog.Logger) http.HandlerFunc {
@@ -67,9 +68,25 @@ func main() {
 	kingpin.Parse()
 
 	logger := promslog.New(promslogConfig)
+	if err := collectors.ConfigurePseudonyms(); err != nil {
+		logger.Error("Unable to configure username pseudonyms", "err", err)
+		os.Exit(1)
+	}
+	if len(*reversePseudonyms) > 0 {
+		found, err := collectors.ReversePseudonyms(*reversePseudonyms, os.Stdin, os.Stdout)
+		if err != nil {
+			logger.Error("Unable to reverse pseudonyms", "err", err)
+			os.Exit(1)
+		}
+		if found < len(*reversePseudonyms) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	logger.Info("Starting ondemand_exporter", "version", version.Info())
 	logger.Info("Build context", "build_context", version.BuildContext())
 	logger.Info("Starting Server", "address", *listenAddr)
+	collectors.ConfigurePaths(logger)
 
 	http.Handle(metricsEndpoint, metricsHandler(logger))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {